@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/brimblehq/migration/internal/manager"
+	"github.com/brimblehq/migration/internal/types"
+)
+
+var bundleCommand = command{
+	name:    "bundle",
+	summary: "Build an offline bundle of packages, binaries and images for air-gapped installs",
+	examples: []string{
+		"brimble bundle",
+		"brimble bundle --arch=arm64 --distro=rockylinux:9",
+		"brimble bundle --distro=debian:12 --output=./bundles/{os}-{arch}.tar.gz",
+	},
+	configure: func(fs *flag.FlagSet) func() error {
+		configPath := fs.String("config", "./config.json", "Path to configuration file")
+		arch := fs.String("arch", "amd64", "Architecture of the target hosts: amd64 or arm64")
+		distro := fs.String("distro", "ubuntu:22.04", "Container image of the target hosts' distribution, used to resolve their packages")
+		insecureDownloads := fs.Bool("insecure-downloads", false, "Download artifacts missing from the download manifest, or every artifact without one, without verifying them")
+		output := fs.String("output", "./brimble-bundle-{os}-{arch}.tar.gz", "Where to write the bundle; {os} expands to the distribution release, such as ubuntu-22.04, and {arch} to the architecture")
+
+		return func() error {
+			return runBundle(*configPath, *insecureDownloads, manager.BundleOptions{
+				Arch:   *arch,
+				Distro: *distro,
+				Output: *output,
+			})
+		}
+	},
+}
+
+// runBundle builds the bundle on this machine. It reads only the config: the
+// license, database and servers are not needed.
+func runBundle(configPath string, insecureDownloads bool, opts manager.BundleOptions) error {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	if insecureDownloads {
+		config.InsecureDownloads = true
+	}
+
+	im := manager.NewInstallationManager(nil, types.Server{}, nil, config, "", nil)
+
+	path, err := im.BuildBundle(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Bundle written to %s ✅\n", path)
+	fmt.Println("Install from it with: brimble setup --bundle=" + path)
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/brimblehq/migration/internal/manager"
+	"github.com/brimblehq/migration/internal/types"
+)
+
+var checksumsCommand = command{
+	name:    "checksums",
+	summary: "Record the SHA-256 sum of every artifact the installer downloads in a download manifest",
+	examples: []string{
+		"brimble checksums",
+		"brimble checksums --output=./downloads.json --list",
+	},
+	configure: func(fs *flag.FlagSet) func() error {
+		configPath := fs.String("config", "./config.json", "Path to configuration file")
+		output := fs.String("output", "./downloads.json", "Download manifest to create or extend")
+		list := fs.Bool("list", false, "Only print the URLs that would be downloaded")
+
+		return func() error {
+			return runChecksums(*configPath, *output, *list)
+		}
+	},
+}
+
+// runChecksums trusts what it downloads on first use: run it from a trusted
+// network, review the manifest and add signatures before pointing
+// download_manifest at it.
+func runChecksums(configPath, output string, list bool) error {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	im := manager.NewInstallationManager(nil, types.Server{}, nil, config, "", nil)
+
+	if list {
+		for _, url := range im.DownloadURLs() {
+			fmt.Println(url)
+		}
+		return nil
+	}
+
+	added, err := im.UpdateDownloadManifest(context.Background(), output)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Added %d checksums to %s ✅\n", added, output)
+	fmt.Println("Review it, then set \"download_manifest\" in the config to verify every download against it.")
+	return nil
+}
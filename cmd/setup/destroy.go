@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/brimblehq/migration/internal/manager"
+	"github.com/brimblehq/migration/internal/types"
+	"github.com/brimblehq/migration/internal/ui"
+)
+
+var destroyCommand = command{
+	name:    "destroy",
+	summary: "Tear down Brimble services on servers and mark them inactive",
+	examples: []string{
+		"brimble destroy --license-key=XXXX-XXXX-XXXX-XXXX --hosts=10.0.0.4",
+		"brimble destroy --license-key=XXXX-XXXX-XXXX-XXXX --all --purge-packages --yes",
+		"brimble destroy --license-key=XXXX-XXXX-XXXX-XXXX --hosts=10.0.0.2 --force",
+	},
+	configure: func(fs *flag.FlagSet) func() error {
+		flags := registerCommonFlags(fs)
+		hosts := fs.String("hosts", "", "Comma-separated hosts or IPs to tear down")
+		all := fs.Bool("all", false, "Tear down every server in the config")
+		purgePackages := fs.Bool("purge-packages", false, "Also uninstall the packages installed during setup")
+		yes := fs.Bool("yes", false, "Skip the confirmation prompt")
+		force := fs.Bool("force", false, "Tear down Nomad servers while other servers stay, without removing their Raft peers (prefer remove-node)")
+
+		return func() error {
+			if *hosts == "" && !*all {
+				return fmt.Errorf("either --hosts or --all is required")
+			}
+			return runDestroy(flags, *hosts, *purgePackages, *force, *yes)
+		}
+	},
+}
+
+type teardownStep struct {
+	name string
+	fn   func() error
+	// undoes is the provisioning step this reverses; hosts that never reached it skip the teardown.
+	undoes types.ServerStep
+}
+
+// teardownSteps lists the teardown in provisioning order; callers run it in
+// reverse. The monitoring jobs are cluster-wide, so they are only purged with
+// the last active servers.
+func teardownSteps(im *manager.InstallationManager, machineID string, purgePackages, purgeMonitoring bool) []teardownStep {
+	var steps []teardownStep
+
+	if purgePackages {
+		steps = append(steps, teardownStep{
+			name: "Uninstalling packages",
+			fn: func() error {
+				if err := im.UninstallPackages(); err != nil {
+					return err
+				}
+				return im.DB.ClearComponents(machineID)
+			},
+			undoes: types.StepBaseInstalled,
+		})
+	}
+
+	steps = append(steps,
+		teardownStep{
+			name:   "Logging out of Tailscale",
+			fn:     im.LeaveTailnet,
+			undoes: types.StepBaseInstalled,
+		},
+		teardownStep{
+			name:   "Removing Consul client",
+			fn:     im.RemoveConsulClient,
+			undoes: types.StepConsulSetup,
+		},
+		teardownStep{
+			name:   "Draining and stopping Nomad",
+			fn:     im.StopNomad,
+			undoes: types.StepNomadSetup,
+		},
+	)
+
+	if purgeMonitoring {
+		steps = append(steps, teardownStep{
+			name:   "Purging monitoring jobs",
+			fn:     im.PurgeMonitoring,
+			undoes: types.StepMonitoringSetup,
+		})
+	}
+
+	return append(steps, teardownStep{
+		name:   "Stopping runner",
+		fn:     im.StopRunner,
+		undoes: types.StepRunnerStarted,
+	})
+}
+
+func runDestroy(flags *commonFlags, hosts string, purgePackages, force, yes bool) error {
+	ctx := context.Background()
+
+	config, err := loadConfig(*flags.configPath)
+	if err != nil {
+		return err
+	}
+
+	servers, err := selectServers(config.Servers, hosts)
+	if err != nil {
+		return err
+	}
+
+	if !yes && !confirm(fmt.Sprintf("This will tear down Brimble on %d server(s). Type 'destroy' to continue: ", len(servers)), "destroy") {
+		return fmt.Errorf("aborted")
+	}
+
+	env, err := newEnvironment(ctx, flags)
+	if err != nil {
+		return err
+	}
+	defer env.Close()
+
+	active, err := env.database.GetAllServers()
+	if err != nil {
+		return err
+	}
+
+	selected := make(map[string]bool)
+	for _, server := range servers {
+		selected[server.PrivateIP] = true
+	}
+
+	var remaining, remainingServers int
+	var servingHosts []string
+	for _, state := range active {
+		switch {
+		case !selected[state.PrivateIP]:
+			remaining++
+			if isServerRole(state.Role) {
+				remainingServers++
+			}
+		case isServerRole(state.Role):
+			servingHosts = append(servingHosts, state.PrivateIP)
+		}
+	}
+
+	// Stopping a Nomad server leaves its Raft peer behind, which counts
+	// against quorum for the servers that stay.
+	if remainingServers > 0 && len(servingHosts) > 0 && !force {
+		return fmt.Errorf("%s run a Nomad server and %d other server(s) stay: take them out with remove-node, or pass --force", strings.Join(servingHosts, ", "), remainingServers)
+	}
+
+	var failed []string
+
+	for _, server := range servers {
+		if err := destroyServer(ctx, env, server, purgePackages, remaining == 0); err != nil {
+			log.Printf("❌ Teardown failed on %s: %v", server.Host, err)
+			failed = append(failed, server.Host)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("teardown failed on %s", strings.Join(failed, ", "))
+	}
+
+	left, err := env.database.GetAllServers()
+	if err != nil {
+		return err
+	}
+	if len(left) == 0 {
+		if err := manager.ForgetNomadTokens(env.database); err != nil {
+			return err
+		}
+	}
+
+	log.Println("Teardown completed ✅")
+	return nil
+}
+
+func destroyServer(ctx context.Context, env *environment, server types.Server, purgePackages, purgeMonitoring bool) error {
+	spinner := ui.NewStepSpinner(server.Host)
+
+	spinner.Start("Connecting to server")
+	client, err := env.connect(server)
+	if err != nil {
+		spinner.Stop(false)
+		return err
+	}
+	defer client.Close()
+
+	machineID, _, err := identify(client)
+	if err != nil {
+		spinner.Stop(false)
+		return err
+	}
+	spinner.Stop(true)
+
+	state, err := env.database.GetServer(machineID)
+	if err != nil {
+		return err
+	}
+
+	// Without a record we cannot tell how far setup got, so every teardown runs.
+	recordedStep := types.StepCompleted
+	if state != nil {
+		recordedStep = state.CurrentStep
+	}
+
+	im := manager.NewInstallationManager(client, server, nil, env.config, env.tailScaleToken, env.database)
+
+	steps := teardownSteps(im, machineID, purgePackages, purgeMonitoring)
+	reachedStep := recordedStep
+
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+
+		if stepOrder[reachedStep] < stepOrder[step.undoes] {
+			continue
+		}
+
+		spinner.Start(step.name)
+		if err := step.fn(); err != nil {
+			spinner.Stop(false)
+			return fmt.Errorf("error during %s: %w", step.name, err)
+		}
+
+		if state != nil {
+			previous := stepSequence[stepOrder[step.undoes]-1]
+			if stepOrder[previous] < stepOrder[recordedStep] {
+				recordedStep = previous
+				if err := env.database.UpdateServerStep(machineID, recordedStep); err != nil {
+					spinner.Stop(false)
+					return fmt.Errorf("error updating step: %v", err)
+				}
+			}
+		}
+		spinner.Stop(true)
+	}
+
+	if state != nil {
+		spinner.Start("Marking server inactive")
+		if err := env.database.UpdateServerStatus(machineID, "inactive"); err != nil {
+			spinner.Stop(false)
+			return err
+		}
+		if err := forgetMember(env, state.PrivateIP); err != nil {
+			spinner.Stop(false)
+			return err
+		}
+		spinner.Stop(true)
+	}
+
+	return nil
+}
+
+// confirm prompts on stdin and reports whether the operator typed the expected answer.
+func confirm(prompt, expected string) bool {
+	fmt.Print(prompt)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+
+	return strings.TrimSpace(answer) == expected
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sync"
+
+	"github.com/brimblehq/migration/internal/manager"
+	"github.com/brimblehq/migration/internal/types"
+	"github.com/brimblehq/migration/internal/ui"
+)
+
+var doctorCommand = command{
+	name:    "doctor",
+	summary: "Check database, SSH access and machine requirements without changing anything",
+	examples: []string{
+		"brimble doctor --license-key=XXXX-XXXX-XXXX-XXXX",
+	},
+	configure: func(fs *flag.FlagSet) func() error {
+		flags := registerCommonFlags(fs)
+
+		return func() error {
+			return runDoctor(flags)
+		}
+	},
+}
+
+func runDoctor(flags *commonFlags) error {
+	ctx := context.Background()
+
+	env, err := newEnvironment(ctx, flags)
+	if err != nil {
+		return err
+	}
+	defer env.Close()
+
+	fmt.Println("Database connection ✅")
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []string
+	)
+
+	for _, server := range env.config.Servers {
+		wg.Add(1)
+
+		go func(server types.Server) {
+			defer wg.Done()
+
+			if err := diagnoseServer(ctx, env, server); err != nil {
+				mu.Lock()
+				failed = append(failed, fmt.Sprintf("%s: %v", server.Host, err))
+				mu.Unlock()
+			}
+		}(server)
+	}
+
+	wg.Wait()
+
+	if len(failed) > 0 {
+		for _, failure := range failed {
+			fmt.Printf("❌ %s\n", failure)
+		}
+		return fmt.Errorf("%d of %d servers failed checks", len(failed), len(env.config.Servers))
+	}
+
+	fmt.Println("All checks passed ✅")
+	return nil
+}
+
+func diagnoseServer(ctx context.Context, env *environment, server types.Server) error {
+	spinner := ui.NewStepSpinner(server.Host)
+
+	spinner.Start("Connecting to server")
+	client, err := env.connect(server)
+	if err != nil {
+		spinner.Stop(false)
+		return err
+	}
+	defer client.Close()
+	spinner.Stop(true)
+
+	spinner.Start("Getting machine info")
+	if _, _, err := identify(client); err != nil {
+		spinner.Stop(false)
+		return err
+	}
+	spinner.Stop(true)
+
+	spinner.Start("Checking sudo access")
+	if _, err := client.ExecuteCommandWithOutput("sudo -n true"); err != nil {
+		spinner.Stop(false)
+		return fmt.Errorf("passwordless sudo is required: %v", err)
+	}
+	spinner.Stop(true)
+
+	spinner.Start("Verifying machine requirements")
+	im := manager.NewInstallationManager(client, server, nil, env.config, env.tailScaleToken, env.database)
+	if err := im.VerifyMachineRequirement(ctx); err != nil {
+		spinner.Stop(false)
+		return err
+	}
+	spinner.Stop(true)
+
+	return nil
+}
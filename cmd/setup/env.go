@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/brimblehq/migration/internal/db"
+	"github.com/brimblehq/migration/internal/license"
+	"github.com/brimblehq/migration/internal/ssh"
+	"github.com/brimblehq/migration/internal/types"
+	infisical "github.com/infisical/go-sdk"
+)
+
+type commonFlags struct {
+	licenseKey *string
+	configPath *string
+	useTemp    *bool
+}
+
+func registerCommonFlags(fs *flag.FlagSet) *commonFlags {
+	return &commonFlags{
+		licenseKey: fs.String("license-key", "", "Your Brimble license key (required)"),
+		configPath: fs.String("config", "./config.json", "Path to configuration file"),
+		useTemp:    fs.Bool("temp-ssh", false, "Use temporary SSH keys for setup"),
+	}
+}
+
+// environment holds everything a command needs to talk to a cluster: the parsed
+// config, the resolved license secrets, the state database and SSH access.
+type environment struct {
+	config         *types.Config
+	licenseKey     string
+	tailScaleToken string
+	database       *db.PostgresDB
+	sshManager     *ssh.TempSSHManager
+	useTemp        bool
+	cleanups       []func()
+}
+
+func loadConfig(path string) (*types.Config, error) {
+	configFile, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %v", err)
+	}
+
+	var config types.Config
+
+	if err := json.Unmarshal(configFile, &config); err != nil {
+		return nil, fmt.Errorf("error parsing config: %v", err)
+	}
+
+	return &config, nil
+}
+
+// resolveSecrets exchanges the license key for the decrypted database URL and Tailscale token.
+func resolveSecrets(licenseKey string) (string, string, error) {
+	dbUrl, tailScaleToken, err := license.GetDatabaseUrl(licenseKey)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get database URL: %v", err)
+	}
+
+	if dbUrl == "" {
+		return "", "", fmt.Errorf("unable to setup this installation: missing database connection URL")
+	}
+
+	client := infisical.NewInfisicalClient(context.Background(), infisical.Config{
+		SiteUrl:          "https://app.infisical.com",
+		AutoTokenRefresh: true,
+	})
+
+	_, err = client.Auth().UniversalAuthLogin("881d58d5-44ed-4950-bfd1-b77f04b9a8e4", "c0ef8cff37718b02a5603c05dbc84ae3109c20edd0b31db2a505602da2295f22")
+	if err != nil {
+		return "", "", fmt.Errorf("authentication failed: %v", err)
+	}
+
+	apiKeySecret, err := client.Secrets().Retrieve(infisical.RetrieveSecretOptions{
+		SecretKey:   "CLI_DECRYPTION_KEY",
+		Environment: "staging",
+		ProjectID:   "64a5804271976de3e38c59c3",
+		SecretPath:  "/",
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to retrieve decryption key: %v", err)
+	}
+
+	decryptedDatabaseValue, err := license.Decrypt(dbUrl, apiKeySecret.SecretValue)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get database URL: %v", err)
+	}
+
+	decryptedTailScaleValue, err := license.Decrypt(tailScaleToken, apiKeySecret.SecretValue)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get tailscale token: %v", err)
+	}
+
+	return decryptedDatabaseValue, decryptedTailScaleValue, nil
+}
+
+// newEnvironment loads the config, resolves the license and connects to the state
+// database. When temporary SSH keys are requested it also waits until every
+// configured server accepts the generated key.
+func newEnvironment(ctx context.Context, flags *commonFlags) (*environment, error) {
+	if *flags.licenseKey == "" {
+		return nil, fmt.Errorf("license key is required")
+	}
+
+	config, err := loadConfig(*flags.configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	dbUrl, tailScaleToken, err := resolveSecrets(*flags.licenseKey)
+	if err != nil {
+		return nil, err
+	}
+
+	database, err := db.NewPostgresDB(db.Config{
+		URI:       dbUrl,
+		SecretKey: *flags.licenseKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %v", err)
+	}
+
+	env := &environment{
+		config:         config,
+		licenseKey:     *flags.licenseKey,
+		tailScaleToken: tailScaleToken,
+		database:       database,
+		useTemp:        *flags.useTemp,
+	}
+	env.cleanups = append(env.cleanups, func() { database.Close() })
+
+	if env.useTemp {
+		if err := env.setupTempSSH(ctx); err != nil {
+			env.Close()
+			return nil, err
+		}
+	}
+
+	return env, nil
+}
+
+func (e *environment) setupTempSSH(ctx context.Context) error {
+	cleanupCtx, cleanupCancel := context.WithCancel(context.Background())
+	e.cleanups = append(e.cleanups, cleanupCancel)
+
+	ssh.CleanupExpiredKeys(cleanupCtx, e.database, e.config)
+
+	servers := make([]string, len(e.config.Servers))
+	for i, server := range e.config.Servers {
+		servers[i] = server.Host
+	}
+
+	sshManager, err := ssh.NewTempSSHManager(e.database, servers)
+	if err != nil {
+		return fmt.Errorf("failed to create SSH manager: %v", err)
+	}
+
+	if err := sshManager.GenerateKeys(ctx); err != nil {
+		return fmt.Errorf("failed to generate SSH keys: %v", err)
+	}
+
+	fmt.Println("\n🔐 Temporary SSH Setup Required")
+
+	fmt.Println(sshManager.GetPublicKeyWithInstructions())
+
+	checkCtx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	if err := ssh.WaitForSSHReadiness(checkCtx, e.config.Servers, sshManager); err != nil {
+		return fmt.Errorf("SSH setup failed: %v", err)
+	}
+
+	e.sshManager = sshManager
+	// The key is revoked once the command is done with every server: hosts
+	// provisioned in parallel or in later batches still connect to the ones
+	// that finished first.
+	e.cleanups = append(e.cleanups, func() {
+		if err := sshManager.Cleanup(context.Background(), e.config.Servers); err != nil {
+			log.Printf("Warning: Failed to revoke the temporary SSH key: %v", err)
+		}
+	})
+	return nil
+}
+
+// Close revokes the temporary SSH key, if one was used, releases the database
+// connection and stops background cleanup.
+func (e *environment) Close() {
+	for i := len(e.cleanups) - 1; i >= 0; i-- {
+		e.cleanups[i]()
+	}
+}
+
+// useBundle points installs at an offline bundle given on the command line,
+// overriding the config.
+func (e *environment) useBundle(path string) {
+	if path != "" {
+		e.config.Bundle = path
+	}
+}
+
+// allowInsecureDownloads lets installs fetch artifacts that cannot be verified
+// when --insecure-downloads is given, overriding the config.
+func (e *environment) allowInsecureDownloads(allow bool) {
+	if allow {
+		e.config.InsecureDownloads = true
+	}
+}
+
+// connect opens an SSH session to server using the configured key or the temporary key.
+func (e *environment) connect(server types.Server) (*ssh.SSHClient, error) {
+	if !e.useTemp {
+		return ssh.NewSSHClient(server, nil)
+	}
+
+	sshConfig, err := e.sshManager.GetSSHConfig(server.Host)
+	if err != nil {
+		return nil, fmt.Errorf("error getting SSH config for %s: %v", server.Host, err)
+	}
+
+	return ssh.NewSSHClient(server, sshConfig)
+}
+
+// identify returns the machine-id and hostname reported by the host.
+func identify(client *ssh.SSHClient) (string, string, error) {
+	machineID, err := client.ExecuteCommandWithOutput("cat /etc/machine-id")
+	if err != nil {
+		return "", "", fmt.Errorf("error getting machine-id: %v", err)
+	}
+
+	hostname, err := client.ExecuteCommandWithOutput("hostname")
+	if err != nil {
+		return "", "", fmt.Errorf("error getting hostname: %v", err)
+	}
+
+	return machineID, strings.TrimSpace(hostname), nil
+}
+
+// shortMachineID trims a machine-id down to something that fits in a table column.
+func shortMachineID(machineID string) string {
+	machineID = strings.TrimSpace(machineID)
+	if len(machineID) > 12 {
+		return machineID[:12]
+	}
+	return machineID
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/brimblehq/migration/internal/ssh"
+)
+
+var keysCommand = command{
+	name:    "keys",
+	summary: "Remove expired temporary SSH keys from the configured servers",
+	examples: []string{
+		"brimble keys --license-key=XXXX-XXXX-XXXX-XXXX",
+	},
+	configure: func(fs *flag.FlagSet) func() error {
+		flags := registerCommonFlags(fs)
+
+		return func() error {
+			return runKeys(flags)
+		}
+	},
+}
+
+func runKeys(flags *commonFlags) error {
+	ctx := context.Background()
+
+	// Cleaning up keys must never mint a new one.
+	*flags.useTemp = false
+
+	env, err := newEnvironment(ctx, flags)
+	if err != nil {
+		return err
+	}
+	defer env.Close()
+
+	if err := ssh.CleanupExpiredKeys(ctx, env.database, env.config); err != nil {
+		return err
+	}
+
+	fmt.Println("Expired temporary SSH keys cleaned up ✅")
+	return nil
+}
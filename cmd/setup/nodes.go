@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/brimblehq/migration/internal/manager"
+	"github.com/brimblehq/migration/internal/ssh"
+	"github.com/brimblehq/migration/internal/types"
+	"github.com/brimblehq/migration/internal/ui"
+)
+
+var addNodeCommand = command{
+	name:    "add-node",
+	summary: "Join a new server to an existing cluster",
+	examples: []string{
+		"brimble add-node --license-key=XXXX-XXXX-XXXX-XXXX --host=10.0.0.7",
+		"brimble add-node --license-key=XXXX-XXXX-XXXX-XXXX --host=10.0.0.7 --as-server",
+		"brimble add-node --license-key=XXXX-XXXX-XXXX-XXXX --host=10.0.0.7 --bundle=./brimble-bundle-{os}-{arch}.tar.gz",
+	},
+	configure: func(fs *flag.FlagSet) func() error {
+		flags := registerCommonFlags(fs)
+		host := fs.String("host", "", "Host or IP of the new server, as listed in the config (required)")
+		asServer := fs.Bool("as-server", false, "Also run a Nomad server on the new node")
+		forceQuorum := fs.Bool("force-quorum", false, "Allow joining as a server when it leaves an even number of Nomad servers")
+		instances := fs.String("instances", "6", "Number of instances for your brimble builder")
+		bundle := fs.String("bundle", "", "Install from an offline bundle built by the bundle command; {os} (the release, such as ubuntu-22.04) and {arch} expand per host")
+		insecureDownloads := fs.Bool("insecure-downloads", false, "Download artifacts missing from the download manifest, or every artifact without one, without verifying them")
+
+		return func() error {
+			if *host == "" {
+				return fmt.Errorf("--host is required")
+			}
+			return runAddNode(flags, *host, *asServer, *forceQuorum, setupOptions{instances: *instances, bundle: *bundle, insecureDownloads: *insecureDownloads})
+		}
+	},
+}
+
+var removeNodeCommand = command{
+	name:    "remove-node",
+	summary: "Drain a server and remove it from the cluster",
+	examples: []string{
+		"brimble remove-node --license-key=XXXX-XXXX-XXXX-XXXX --host=10.0.0.7",
+	},
+	configure: func(fs *flag.FlagSet) func() error {
+		flags := registerCommonFlags(fs)
+		host := fs.String("host", "", "Host or IP of the server to remove, as listed in the config (required)")
+		force := fs.Bool("force", false, "Remove a Nomad server even when another server is already down or it is missing from the Raft peer set")
+		yes := fs.Bool("yes", false, "Skip the confirmation prompt")
+
+		return func() error {
+			if *host == "" {
+				return fmt.Errorf("--host is required")
+			}
+			return runRemoveNode(flags, *host, *force, *yes)
+		}
+	},
+}
+
+// runAddNode adds one configured host to the recorded topology and provisions
+// it. Existing nodes keep their roles and are not reconnected, so their
+// nomad.hcl is left untouched.
+func runAddNode(flags *commonFlags, host string, asServer, forceQuorum bool, opts setupOptions) error {
+	ctx := context.Background()
+
+	env, err := newEnvironment(ctx, flags)
+	if err != nil {
+		return err
+	}
+	defer env.Close()
+	env.useBundle(opts.bundle)
+	env.allowInsecureDownloads(opts.insecureDownloads)
+
+	selected, err := selectServers(env.config.Servers, host)
+	if err != nil {
+		return err
+	}
+	server := selected[0]
+
+	topology, err := recordedTopology(env)
+	if err != nil {
+		return err
+	}
+	if topology == nil || len(topology.Members) == 0 {
+		return fmt.Errorf("no cluster topology is recorded, run setup first")
+	}
+
+	existingServers, err := env.database.GetAllServers()
+	if err != nil {
+		return fmt.Errorf("failed to get existing servers: %v", err)
+	}
+
+	for _, srv := range existingServers {
+		if srv.PrivateIP == server.PrivateIP && srv.Status == "active" && srv.CurrentStep == types.StepCompleted {
+			return fmt.Errorf("%s is already a member of the cluster", server.Host)
+		}
+	}
+
+	server.Roles = []types.ClusterRole{types.RoleClient}
+	if asServer {
+		server.Roles = append(server.Roles, types.RoleServer)
+	}
+
+	// A host left over from an interrupted add-node keeps its recorded roles.
+	if _, err := manager.ExtendTopology(topology, []types.Server{server}, forceQuorum); err != nil {
+		return fmt.Errorf("cannot join %s: %v; add servers in pairs or pass --force-quorum", server.Host, err)
+	}
+
+	if err := env.database.SaveTopology(topology); err != nil {
+		return err
+	}
+
+	cluster := manager.NewClusterManager(topology)
+	roles := cluster.GetServerRoles(server.Host)
+
+	r := newRollout(env, cluster, []types.Server{server}, 1)
+	r.acquire()
+	defer r.release()
+
+	if result := provisionHost(ctx, env, server, cluster, r, opts); result.err != nil {
+		return result.err
+	}
+
+	log.Printf("%s joined the cluster as %s ✅", server.Host, formatRoles(roles))
+	return nil
+}
+
+// runRemoveNode drains a host, takes it out of the Raft peer set if it runs a
+// Nomad server, leaves Consul and marks it inactive.
+func runRemoveNode(flags *commonFlags, host string, force, yes bool) error {
+	ctx := context.Background()
+
+	env, err := newEnvironment(ctx, flags)
+	if err != nil {
+		return err
+	}
+	defer env.Close()
+
+	selected, err := selectServers(env.config.Servers, host)
+	if err != nil {
+		return err
+	}
+	server := selected[0]
+
+	if !yes && !confirm(fmt.Sprintf("This will drain %s and remove it from the cluster. Type 'remove' to continue: ", server.Host), "remove") {
+		return fmt.Errorf("aborted")
+	}
+
+	spinner := ui.NewStepSpinner(server.Host)
+
+	spinner.Start("Connecting to server")
+	client, err := env.connect(server)
+	if err != nil {
+		spinner.Stop(false)
+		return err
+	}
+	defer client.Close()
+
+	machineID, _, err := identify(client)
+	if err != nil {
+		spinner.Stop(false)
+		return err
+	}
+	spinner.Stop(true)
+
+	state, err := env.database.GetServer(machineID)
+	if err != nil {
+		return err
+	}
+	if state == nil || state.Status != "active" {
+		return fmt.Errorf("%s is not an active member of the cluster", server.Host)
+	}
+
+	im := manager.NewInstallationManager(client, server, nil, env.config, env.tailScaleToken, env.database)
+
+	var peer *manager.InstallationManager
+	peerAddress := fmt.Sprintf("%s:4647", state.ClusterAddress())
+
+	if isServerRole(state.Role) {
+		peerServer, peerClient, err := connectPeerServer(ctx, env, machineID)
+		if err != nil {
+			return err
+		}
+		defer peerClient.Close()
+
+		peer = manager.NewInstallationManager(peerClient, peerServer, nil, env.config, env.tailScaleToken, env.database)
+
+		spinner.Start("Checking Nomad quorum")
+		if err := peer.CheckRaftRemoval(peerAddress, force); err != nil {
+			spinner.Stop(false)
+			return err
+		}
+		spinner.Stop(true)
+	}
+
+	steps := []teardownStep{
+		{name: "Stopping runner", fn: im.StopRunner},
+		{name: "Draining Nomad allocations", fn: func() error { return im.DrainNode(ctx) }},
+		{name: "Stopping Nomad", fn: im.StopNomad},
+	}
+
+	if peer != nil {
+		steps = append(steps, teardownStep{
+			name: "Removing Raft peer",
+			fn:   func() error { return peer.RemoveRaftPeer(peerAddress) },
+		})
+	}
+
+	steps = append(steps, teardownStep{name: "Leaving Consul", fn: im.RemoveConsulClient})
+
+	for _, step := range steps {
+		spinner.Start(step.name)
+		if err := step.fn(); err != nil {
+			spinner.Stop(false)
+			return fmt.Errorf("error during %s: %v", step.name, err)
+		}
+		spinner.Stop(true)
+	}
+
+	spinner.Start("Marking server inactive")
+	if err := env.database.UpdateServerStatus(machineID, "inactive"); err != nil {
+		spinner.Stop(false)
+		return err
+	}
+	if err := forgetMember(env, state.PrivateIP); err != nil {
+		spinner.Stop(false)
+		return err
+	}
+	spinner.Stop(true)
+
+	log.Printf("%s removed from the cluster ✅", server.Host)
+	return nil
+}
+
+// connectPeerServer opens an SSH session to an active Nomad server other than the one being removed.
+func connectPeerServer(ctx context.Context, env *environment, leavingMachineID string) (types.Server, *ssh.SSHClient, error) {
+	existingServers, err := env.database.GetAllServers()
+	if err != nil {
+		return types.Server{}, nil, fmt.Errorf("failed to get existing servers: %v", err)
+	}
+
+	for _, state := range existingServers {
+		if state.MachineID == leavingMachineID || !isServerRole(state.Role) {
+			continue
+		}
+
+		server, ok := configuredServer(env.config, state)
+		if !ok {
+			continue
+		}
+
+		client, err := env.connect(server)
+		if err != nil {
+			log.Printf("Skipping Nomad server %s: %v", server.Host, err)
+			continue
+		}
+
+		return server, client, nil
+	}
+
+	return types.Server{}, nil, fmt.Errorf("no other reachable Nomad server found in the config to update the Raft peer set")
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/brimblehq/migration/internal/manager"
+	"github.com/brimblehq/migration/internal/pipeline"
+	"github.com/brimblehq/migration/internal/types"
+)
+
+// unknownMachineID stands in for /etc/machine-id when a host cannot be reached while planning.
+const unknownMachineID = "<machine>"
+
+// runPlan prints, per host and in execution order, every command setup would run
+// from the step currently recorded for that host. The only remote commands it
+// issues read /etc/machine-id and detect the host's OS and architecture.
+func runPlan(flags *commonFlags, opts setupOptions) error {
+	// Planning must not mint temporary keys or register them in the database.
+	*flags.useTemp = false
+
+	env, err := newEnvironment(context.Background(), flags)
+	if err != nil {
+		return err
+	}
+	defer env.Close()
+	env.useBundle(opts.bundle)
+	env.allowInsecureDownloads(opts.insecureDownloads)
+
+	cluster, err := loadTopology(env, opts, false)
+	if err != nil {
+		return err
+	}
+
+	existingServers, err := env.database.GetAllServers()
+	if err != nil {
+		return fmt.Errorf("failed to get existing servers: %v", err)
+	}
+
+	servers, err := selectServers(env.config.Servers, opts.hosts)
+	if err != nil {
+		return err
+	}
+
+	recorded := make(map[string]types.ServerState)
+	for _, srv := range existingServers {
+		recorded[srv.PrivateIP] = srv
+	}
+
+	for _, server := range servers {
+		currentStep := types.StepInitialized
+		if state, ok := recorded[server.PrivateIP]; ok && state.CurrentStep != "" {
+			currentStep = state.CurrentStep
+		}
+
+		rewound, err := opts.selection.rewind(currentStep)
+		if err != nil {
+			return fmt.Errorf("%s: %v", server.Host, err)
+		}
+
+		roles := cluster.GetServerRoles(server.Host)
+		im := manager.NewInstallationManager(nil, server, cluster, env.config, env.tailScaleToken, env.database)
+		machineID := inspectPlanHost(env, server, im)
+
+		fmt.Printf("\n=== %s (roles: %s, current step: %s)\n", server.Host, formatRoles(roles), currentStep)
+		if rewound != currentStep {
+			fmt.Printf("    # recorded step would be rewound to %s\n", rewound)
+			currentStep = rewound
+		}
+
+		steps := provisioningPipeline(im, machineID, env.licenseKey, opts.instances, nil)
+
+	planSteps:
+		for _, step := range steps.Steps() {
+			if !opts.selection.includes(step.ID) {
+				continue
+			}
+
+			switch state, waitingFor := steps.Check(currentStep, step); state {
+			case pipeline.StateDone:
+				fmt.Printf("\n[skip] %s (already %s)\n", step.Name, currentStep)
+				continue
+			case pipeline.StateBlocked:
+				fmt.Printf("\n[blocked] %s requires %s\n", step.Name, waitingFor)
+				break planSteps
+			}
+
+			if step.Skip != nil && step.Skip() {
+				fmt.Printf("\n[off] %s (disabled in components) -> %s\n", step.Name, step.ID)
+				currentStep = step.ID
+				continue
+			}
+
+			commands, err := step.Plan()
+			if err != nil {
+				return fmt.Errorf("failed to plan %s on %s: %v", step.Name, server.Host, err)
+			}
+
+			fmt.Printf("\n[run] %s -> %s\n", step.Name, step.ID)
+			for _, cmd := range commands {
+				if strings.HasPrefix(cmd, "#") {
+					fmt.Printf("    %s\n", cmd)
+					continue
+				}
+				fmt.Printf("    $ %s\n", cmd)
+			}
+
+			currentStep = step.ID
+		}
+
+		nomadConfig, err := im.NomadConfig(machineID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\n--- /etc/nomad.d/nomad.hcl ---\n%s\n", strings.TrimSpace(nomadConfig))
+	}
+
+	return nil
+}
+
+// inspectPlanHost reads the host's machine-id over SSH and has im detect its OS
+// and architecture on the same connection. An unreachable host gets a
+// placeholder machine-id, and im assumes Debian/Ubuntu on amd64.
+func inspectPlanHost(env *environment, server types.Server, im *manager.InstallationManager) string {
+	client, err := env.connect(server)
+	if err != nil {
+		fmt.Printf("\nNote: %s is unreachable, node names use a placeholder and Debian/Ubuntu on amd64 is assumed: %v\n", server.Host, err)
+		return unknownMachineID
+	}
+	defer client.Close()
+
+	if err := im.InspectHost(client); err != nil {
+		fmt.Printf("\nNote: %v on %s, Debian/Ubuntu on amd64 is assumed\n", err, server.Host)
+	}
+
+	machineID, _, err := identify(client)
+	if err != nil {
+		fmt.Printf("\nNote: %v on %s, node names use a placeholder\n", err, server.Host)
+		return unknownMachineID
+	}
+
+	return machineID
+}
+
+func formatRoles(roles []types.ClusterRole) string {
+	if len(roles) == 0 {
+		return "none"
+	}
+
+	names := make([]string, len(roles))
+	for i, role := range roles {
+		names[i] = string(role)
+	}
+	return strings.Join(names, ", ")
+}
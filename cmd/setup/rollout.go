@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/brimblehq/migration/internal/manager"
+	"github.com/brimblehq/migration/internal/pipeline"
+	"github.com/brimblehq/migration/internal/types"
+)
+
+// rollout coordinates the hosts provisioned together. Clients join Nomad, and
+// monitoring is deployed, only once every Nomad server in the rollout has Nomad
+// set up and the servers have elected a leader. Monitoring is deployed once,
+// from the first host that reaches that step.
+type rollout struct {
+	env     *environment
+	cluster *manager.ClusterManager
+
+	// slots caps how many hosts run steps at once. A host waiting on the
+	// cluster gives its slot up so the hosts it waits for can run.
+	slots chan struct{}
+
+	serversUp *pipeline.Barrier
+
+	readyOnce sync.Once
+	readyErr  error
+
+	monitoringOnce sync.Once
+	monitoringErr  error
+}
+
+func newRollout(env *environment, cluster *manager.ClusterManager, servers []types.Server, parallel int) *rollout {
+	serverHosts := 0
+	for _, server := range servers {
+		if manager.HasRole(cluster.GetServerRoles(server.Host), types.RoleServer) {
+			serverHosts++
+		}
+	}
+
+	return &rollout{
+		env:       env,
+		cluster:   cluster,
+		slots:     make(chan struct{}, batchSize(parallel, len(servers))),
+		serversUp: pipeline.NewBarrier(serverHosts),
+	}
+}
+
+func (r *rollout) acquire() {
+	r.slots <- struct{}{}
+}
+
+func (r *rollout) release() {
+	<-r.slots
+}
+
+// serverArrived is called once per Nomad server in the rollout, when its Nomad
+// step is recorded or when it stops short of it.
+func (r *rollout) serverArrived() {
+	r.serversUp.Arrive()
+}
+
+// clusterReady blocks until the servers in the rollout have arrived, a Nomad
+// leader is elected and, when enabled, Nomad ACLs are bootstrapped.
+func (r *rollout) clusterReady(ctx context.Context) error {
+	if r == nil {
+		return nil
+	}
+
+	r.release()
+	err := r.serversUp.Wait(ctx)
+	r.acquire()
+	if err != nil {
+		return err
+	}
+
+	r.readyOnce.Do(func() {
+		r.readyErr = r.waitForLeader(ctx)
+	})
+	return r.readyErr
+}
+
+// waitForLeader asks the configured Nomad servers, those recorded at the
+// Nomad step or later first, whether a leader is elected and bootstraps Nomad
+// ACLs through the first one that answers. A server that cannot be reached or
+// fails is skipped for the next.
+func (r *rollout) waitForLeader(ctx context.Context) error {
+	recorded := make(map[string]types.ServerStep)
+	if states, err := r.env.database.GetAllServers(); err == nil {
+		for _, state := range states {
+			recorded[state.PrivateIP] = state.CurrentStep
+		}
+	} else {
+		log.Printf("Warning: could not read recorded server steps: %v", err)
+	}
+
+	var servers []types.Server
+	for _, host := range r.cluster.ServerHosts {
+		if server, ok := configuredHost(r.env.config, host); ok {
+			servers = append(servers, server)
+		}
+	}
+	sort.SliceStable(servers, func(i, j int) bool {
+		return nomadRecorded(recorded[servers[i].PrivateIP]) && !nomadRecorded(recorded[servers[j].PrivateIP])
+	})
+
+	lastErr := fmt.Errorf("no reachable Nomad server found in the config to check for a leader")
+	for _, server := range servers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		client, err := r.env.connect(server)
+		if err != nil {
+			log.Printf("Skipping Nomad server %s: %v", server.Host, err)
+			lastErr = err
+			continue
+		}
+
+		im := manager.NewInstallationManager(client, server, r.cluster, r.env.config, r.env.tailScaleToken, r.env.database)
+		err = im.WaitForNomadLeader(ctx)
+		if err == nil {
+			err = im.BootstrapACL()
+		}
+		client.Close()
+
+		if err == nil {
+			return nil
+		}
+		log.Printf("Nomad server %s could not confirm a leader: %v", server.Host, err)
+		lastErr = fmt.Errorf("%s: %w", server.Host, err)
+	}
+
+	return lastErr
+}
+
+// nomadRecorded reports whether a server's recorded step is the Nomad step or
+// later. It cannot use stepOrder, which is built from the pipeline that calls it.
+func nomadRecorded(step types.ServerStep) bool {
+	switch step {
+	case types.StepNomadSetup, types.StepMonitoringSetup, types.StepRunnerStarted, types.StepCompleted:
+		return true
+	}
+	return false
+}
+
+// deployMonitoring runs the monitoring jobs once for the whole rollout; every
+// host gets the outcome of that one deployment.
+func (r *rollout) deployMonitoring(ctx context.Context, im *manager.InstallationManager) error {
+	if r == nil {
+		return im.SetupMonitoring(ctx)
+	}
+
+	r.monitoringOnce.Do(func() {
+		r.monitoringErr = im.SetupMonitoring(ctx)
+	})
+	return r.monitoringErr
+}
+
+func configuredHost(config *types.Config, host string) (types.Server, bool) {
+	for _, server := range config.Servers {
+		if server.Host == host {
+			return server, true
+		}
+	}
+	return types.Server{}, false
+}
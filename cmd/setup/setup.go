@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/brimblehq/migration/internal/license"
+	"github.com/brimblehq/migration/internal/manager"
+	"github.com/brimblehq/migration/internal/pipeline"
+	"github.com/brimblehq/migration/internal/types"
+	"github.com/brimblehq/migration/internal/ui"
+)
+
+var setupCommand = command{
+	name:    "setup",
+	summary: "Provision every server in the config file into a Brimble cluster",
+	examples: []string{
+		"brimble setup --license-key=XXXX-XXXX-XXXX-XXXX",
+		"brimble setup --license-key=XXXX-XXXX-XXXX-XXXX --config=./my-config.json",
+		"brimble setup --license-key=XXXX-XXXX-XXXX-XXXX --plan",
+		"brimble setup --license-key=XXXX-XXXX-XXXX-XXXX --hosts=10.0.0.2 --only-step=consul_setup",
+		"brimble setup --license-key=XXXX-XXXX-XXXX-XXXX --continue-on-error",
+		"brimble setup --license-key=XXXX-XXXX-XXXX-XXXX --parallel=3 --canary",
+		"brimble setup --license-key=XXXX-XXXX-XXXX-XXXX --bundle=./brimble-bundle-{os}-{arch}.tar.gz",
+	},
+	configure: func(fs *flag.FlagSet) func() error {
+		flags := registerCommonFlags(fs)
+		instances := fs.String("instances", "6", "Number of instances for your brimble builder")
+		plan := fs.Bool("plan", false, "Print the commands each server would run without executing them")
+		hosts := fs.String("hosts", "", "Comma-separated hosts or IPs to provision (default: all servers in the config)")
+		fromStep := fs.String("from-step", "", "Rewind the selected hosts to this step and re-run it and every later step")
+		onlyStep := fs.String("only-step", "", "Re-run only this step on the selected hosts")
+		forceQuorum := fs.Bool("force-quorum", false, "Allow a topology with an even number of Nomad servers")
+		replan := fs.Bool("replan", false, "Discard the recorded topology and plan roles again from the config")
+		continueOnError := fs.Bool("continue-on-error", false, "Keep provisioning the other hosts when one fails")
+		parallel := fs.Int("parallel", 0, "Maximum number of hosts provisioned at once (default: all)")
+		canary := fs.Bool("canary", false, "Provision one host, or one --parallel batch, first and continue only if it completes")
+		bundle := fs.String("bundle", "", "Install from an offline bundle built by the bundle command; {os} (the release, such as ubuntu-22.04) and {arch} expand per host")
+		insecureDownloads := fs.Bool("insecure-downloads", false, "Download artifacts missing from the download manifest, or every artifact without one, without verifying them")
+
+		return func() error {
+			selection, err := parseStepSelection(*fromStep, *onlyStep)
+			if err != nil {
+				return err
+			}
+
+			opts := setupOptions{
+				instances:         *instances,
+				hosts:             *hosts,
+				selection:         selection,
+				forceQuorum:       *forceQuorum,
+				replan:            *replan,
+				continueOnError:   *continueOnError,
+				parallel:          *parallel,
+				canary:            *canary,
+				bundle:            *bundle,
+				insecureDownloads: *insecureDownloads,
+			}
+
+			if *plan {
+				return runPlan(flags, opts)
+			}
+			return runSetup(flags, opts)
+		}
+	},
+}
+
+type setupOptions struct {
+	instances   string
+	hosts       string
+	selection   stepSelection
+	forceQuorum bool
+	replan      bool
+	// continueOnError lets the other hosts finish when one fails instead of stopping them.
+	continueOnError bool
+	parallel        int
+	canary          bool
+	// bundle overrides the config's offline bundle path.
+	bundle string
+	// insecureDownloads allows downloads that cannot be verified.
+	insecureDownloads bool
+}
+
+// hostResult is how far provisioning got on one host.
+type hostResult struct {
+	host string
+	// lastStep is the last step recorded as done on the host.
+	lastStep   types.ServerStep
+	failedStep string
+	err        error
+}
+
+var (
+	// errSkipped marks hosts that stopped because another host failed first.
+	errSkipped = errors.New("skipped after another host failed")
+	// errCanaryFailed marks hosts that were never started because the canary batch did not complete.
+	errCanaryFailed = errors.New("not started, the canary batch did not complete")
+)
+
+// batchSize caps parallel at the number of hosts; zero or less means no limit.
+func batchSize(parallel, hosts int) int {
+	if parallel <= 0 || parallel > hosts {
+		return hosts
+	}
+	return parallel
+}
+
+// canaryFailed reports whether any canary host stopped short of StepCompleted.
+func canaryFailed(results []hostResult) bool {
+	for _, result := range results {
+		if result.err != nil || result.lastStep != types.StepCompleted {
+			return true
+		}
+	}
+	return false
+}
+
+func runSetup(flags *commonFlags, opts setupOptions) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	env, err := newEnvironment(ctx, flags)
+	if err != nil {
+		return err
+	}
+	defer env.Close()
+	env.useBundle(opts.bundle)
+	env.allowInsecureDownloads(opts.insecureDownloads)
+
+	cluster, err := loadTopology(env, opts, true)
+	if err != nil {
+		return err
+	}
+
+	servers, err := selectServers(env.config.Servers, opts.hosts)
+	if err != nil {
+		return err
+	}
+
+	// Nomad servers go first: clients and monitoring wait for them.
+	sort.SliceStable(servers, func(i, j int) bool {
+		return manager.HasRole(cluster.GetServerRoles(servers[i].Host), types.RoleServer) &&
+			!manager.HasRole(cluster.GetServerRoles(servers[j].Host), types.RoleServer)
+	})
+
+	results := make([]hostResult, len(servers))
+
+	provision := func(from, to int) {
+		var wg sync.WaitGroup
+		r := newRollout(env, cluster, servers[from:to], opts.parallel)
+
+		for i := from; i < to; i++ {
+			wg.Add(1)
+
+			go func(result *hostResult, server types.Server) {
+				defer wg.Done()
+
+				r.acquire()
+				defer r.release()
+
+				*result = provisionHost(ctx, env, server, cluster, r, opts)
+
+				if result.err != nil && result.err != errSkipped && !opts.continueOnError {
+					cancel()
+				}
+			}(&results[i], servers[i])
+		}
+
+		wg.Wait()
+	}
+
+	provisionBatches(servers, cluster, opts, results, provision)
+
+	printSetupSummary(results)
+
+	var failed []string
+	for _, result := range results {
+		if result.err != nil {
+			failed = append(failed, result.host)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("provisioning failed on %s", strings.Join(failed, ", "))
+	}
+
+	log.Println("Infrastructure setup completed ✅")
+	return nil
+}
+
+// provisionBatches provisions servers, Nomad servers first, through provision.
+// With --canary a first batch must complete before the rest start; otherwise
+// the rest are marked errCanaryFailed in results. Temporary SSH keys outlive
+// every batch: they are only revoked when the environment closes.
+func provisionBatches(servers []types.Server, cluster *manager.ClusterManager, opts setupOptions, results []hostResult, provision func(from, to int)) {
+	remaining := 0
+	if opts.canary && len(servers) > 1 {
+		remaining = canaryBatch(servers, cluster, opts.parallel)
+
+		log.Printf("Provisioning canary batch of %d host(s) first", remaining)
+		provision(0, remaining)
+
+		if canaryFailed(results[:remaining]) {
+			for i := remaining; i < len(servers); i++ {
+				results[i] = hostResult{host: servers[i].Host, failedStep: "-", err: errCanaryFailed}
+			}
+			return
+		}
+	}
+
+	provision(remaining, len(servers))
+}
+
+// canaryBatch is how many hosts the canary batch takes: one, or one --parallel
+// batch, and every Nomad server of the run, since one server cannot elect a
+// leader on its own.
+func canaryBatch(servers []types.Server, cluster *manager.ClusterManager, parallel int) int {
+	size := 1
+	if parallel > 0 {
+		size = batchSize(parallel, len(servers))
+	}
+
+	for size < len(servers) && manager.HasRole(cluster.GetServerRoles(servers[size].Host), types.RoleServer) {
+		size++
+	}
+	return size
+}
+
+// printSetupSummary lists, per host, the last step recorded as done and where it failed.
+func printSetupSummary(results []hostResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "HOST\tLAST STEP\tFAILED STEP\tERROR")
+	for _, result := range results {
+		failedStep, message := "-", "-"
+		if result.err != nil {
+			failedStep = result.failedStep
+			message = result.err.Error()
+		}
+
+		lastStep := string(result.lastStep)
+		if lastStep == "" {
+			lastStep = "-"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", result.host, lastStep, failedStep, message)
+	}
+	w.Flush()
+}
+
+// provisionHost walks one server through the provisioning steps, starting from
+// the step recorded for it in the database, with the roles cluster assigns it.
+func provisionHost(ctx context.Context, env *environment, server types.Server, cluster *manager.ClusterManager, r *rollout, opts setupOptions) hostResult {
+	database := env.database
+	roles := cluster.GetServerRoles(server.Host)
+	spinner := ui.NewStepSpinner(server.Host)
+
+	// Servers count in once Nomad is set up, or when they stop short of it.
+	var arrived sync.Once
+	serverUp := func() {
+		if manager.HasRole(roles, types.RoleServer) {
+			arrived.Do(r.serverArrived)
+		}
+	}
+	defer serverUp()
+
+	result := hostResult{host: server.Host}
+	fail := func(step string, err error) hostResult {
+		result.failedStep = step
+		result.err = err
+		return result
+	}
+
+	client, err := env.connect(server)
+	if err != nil {
+		spinner.Start("Connecting to server")
+		spinner.Stop(false)
+		return fail("connect", fmt.Errorf("error connecting to %s: %v", server.Host, err))
+	}
+
+	defer client.Close()
+
+	spinner.Start("Getting machine info")
+	machineID, hostname, err := identify(client)
+	if err != nil {
+		spinner.Stop(false)
+		return fail("machine info", fmt.Errorf("error getting machine info from %s: %v", server.Host, err))
+	}
+	spinner.Stop(true)
+
+	spinner.Start("Validating license")
+	licenseResp, err := license.ValidateLicenseKey(env.licenseKey, strings.TrimSpace(machineID), hostname)
+	if err != nil || !licenseResp.Valid {
+		spinner.Stop(false)
+		return fail("license", fmt.Errorf("invalid license for server %s, reach out to hello@brimble.app for support", server.Host))
+	}
+	spinner.Stop(true)
+
+	currentStep, err := database.GetServerStep(machineID, licenseResp.Subscription.ID)
+
+	log.Printf("Debug: Current step for server %s: %s", server.Host, currentStep)
+
+	if err != nil {
+		err = database.RegisterServer(
+			machineID,
+			server.PublicIP,
+			server.PrivateIP,
+			manager.RoleName(roles),
+			licenseResp.Subscription.ID,
+			types.StepInitialized,
+		)
+		if err != nil {
+			spinner.Stop(false)
+			return fail("register", fmt.Errorf("error registering server %s: %v", server.Host, err))
+		}
+		currentStep = types.StepInitialized
+	} else if err := database.UpdateServerRole(machineID, manager.RoleName(roles)); err != nil {
+		spinner.Stop(false)
+		return fail("register", fmt.Errorf("error recording role for server %s: %v", server.Host, err))
+	} else if err := database.UpdateServerStatus(machineID, "active"); err != nil {
+		// destroy and remove-node leave the row inactive; provisioning the
+		// machine again brings it back.
+		spinner.Stop(false)
+		return fail("register", fmt.Errorf("error reactivating server %s: %v", server.Host, err))
+	}
+
+	recordedStep := currentStep
+	result.lastStep = currentStep
+
+	if rewound, err := opts.selection.rewind(currentStep); err != nil {
+		return fail("rewind", fmt.Errorf("%s: %v", server.Host, err))
+	} else if rewound != currentStep {
+		if err := database.UpdateServerStep(machineID, rewound); err != nil {
+			return fail("rewind", fmt.Errorf("error rewinding step for server %s: %v", server.Host, err))
+		}
+		currentStep = rewound
+		result.lastStep = rewound
+	}
+
+	im := manager.NewInstallationManager(client, server, cluster, env.config, env.tailScaleToken, database)
+
+	arch, err := im.Architecture()
+	if err != nil {
+		return fail("register", fmt.Errorf("%s: %v", server.Host, err))
+	}
+	if err := database.UpdateServerArch(machineID, arch); err != nil {
+		return fail("register", fmt.Errorf("error recording architecture for server %s: %v", server.Host, err))
+	}
+
+	steps := provisioningPipeline(im, machineID, env.licenseKey, opts.instances, r)
+	steps.Tune(env.config.Timeouts.Steps)
+
+	if stepOrder[currentStep] >= stepOrder[types.StepNomadSetup] {
+		serverUp()
+	}
+
+	currentStep, err = steps.Run(ctx, currentStep, pipeline.Options{
+		Only: opts.selection.only,
+		Hooks: pipeline.Hooks{
+			Start: func(step pipeline.Step) {
+				spinner.Start(step.Name)
+			},
+			Skipped: func(step pipeline.Step) {
+				spinner.Start(step.Name + " (disabled in components)")
+			},
+			Done: func(step pipeline.Step) error {
+				if err := database.UpdateServerStep(machineID, step.ID); err != nil {
+					return fmt.Errorf("error updating step for server %s: %v", server.Host, err)
+				}
+				result.lastStep = step.ID
+				if step.ID == types.StepNomadSetup {
+					serverUp()
+				}
+				spinner.Stop(true)
+				return nil
+			},
+			Fail: func(step pipeline.Step, err error) {
+				spinner.Stop(false)
+			},
+		},
+	})
+	if err != nil {
+		var stepErr *pipeline.StepError
+		errors.As(err, &stepErr)
+
+		if ctx.Err() != nil && errors.Is(err, context.Canceled) {
+			return fail(string(stepErr.Step), errSkipped)
+		}
+		return fail(string(stepErr.Step), fmt.Errorf("%s: %v", server.Host, err))
+	}
+
+	// A single re-run step leaves the later steps as they were recorded.
+	if opts.selection.only != "" {
+		if stepOrder[recordedStep] > stepOrder[currentStep] {
+			if err := database.UpdateServerStep(machineID, recordedStep); err != nil {
+				return fail(string(types.StepCompleted), fmt.Errorf("error restoring step for server %s: %v", server.Host, err))
+			}
+			result.lastStep = recordedStep
+		}
+		return result
+	}
+
+	if err := database.UpdateServerStep(machineID, types.StepCompleted); err != nil {
+		return fail(string(types.StepCompleted), fmt.Errorf("error marking server %s as completed: %v", server.Host, err))
+	}
+	result.lastStep = types.StepCompleted
+
+	return result
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/brimblehq/migration/internal/manager"
+	"github.com/brimblehq/migration/internal/types"
+)
+
+// testCluster has servers Nomad servers followed by clients clients.
+func testCluster(servers, clients int) ([]types.Server, *manager.ClusterManager) {
+	var hosts []types.Server
+	topology := &types.Topology{}
+
+	for i := 0; i < servers+clients; i++ {
+		server := types.Server{Host: fmt.Sprintf("host-%d", i), PrivateIP: fmt.Sprintf("10.0.0.%d", i+1)}
+		roles := []types.ClusterRole{types.RoleClient}
+		if i < servers {
+			roles = []types.ClusterRole{types.RoleServer}
+		}
+
+		hosts = append(hosts, server)
+		topology.Members = append(topology.Members, types.ClusterMember{Server: server, Roles: roles})
+	}
+
+	return hosts, manager.NewClusterManager(topology)
+}
+
+func TestProvisionBatchesCanaryWithTempSSH(t *testing.T) {
+	tests := []struct {
+		name     string
+		servers  int
+		clients  int
+		parallel int
+		fail     bool
+		batches  [][2]int
+	}{
+		{name: "single server canary", servers: 1, clients: 3, batches: [][2]int{{0, 1}, {1, 4}}},
+		{name: "canary takes every server", servers: 3, clients: 2, batches: [][2]int{{0, 3}, {3, 5}}},
+		{name: "parallel canary", servers: 1, clients: 5, parallel: 2, batches: [][2]int{{0, 2}, {2, 6}}},
+		{name: "failed canary stops the rest", servers: 1, clients: 3, fail: true, batches: [][2]int{{0, 1}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servers, cluster := testCluster(tt.servers, tt.clients)
+			results := make([]hostResult, len(servers))
+
+			// The temporary key is revoked by an environment cleanup, as
+			// setupTempSSH registers it.
+			revoked := false
+			env := &environment{useTemp: true}
+			env.cleanups = append(env.cleanups, func() { revoked = true })
+
+			var batches [][2]int
+			provision := func(from, to int) {
+				if revoked {
+					t.Errorf("temporary key revoked before batch %d-%d", from, to)
+				}
+				batches = append(batches, [2]int{from, to})
+
+				for i := from; i < to; i++ {
+					results[i] = hostResult{host: servers[i].Host, lastStep: types.StepCompleted}
+					if tt.fail {
+						results[i].lastStep = types.StepVerified
+					}
+				}
+			}
+
+			opts := setupOptions{canary: true, parallel: tt.parallel}
+			provisionBatches(servers, cluster, opts, results, provision)
+			env.Close()
+
+			if !reflect.DeepEqual(batches, tt.batches) {
+				t.Errorf("batches = %v, want %v", batches, tt.batches)
+			}
+			if !revoked {
+				t.Error("temporary key not revoked after the last batch")
+			}
+
+			if tt.fail {
+				for _, result := range results[tt.batches[0][1]:] {
+					if result.err != errCanaryFailed {
+						t.Errorf("%s: error = %v, want %v", result.host, result.err, errCanaryFailed)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/brimblehq/migration/internal/manager"
+	"github.com/brimblehq/migration/internal/types"
+)
+
+var statusCommand = command{
+	name:    "status",
+	summary: "Show the step, role and live Nomad/Consul health of every registered server",
+	examples: []string{
+		"brimble status --license-key=XXXX-XXXX-XXXX-XXXX",
+		"brimble status --license-key=XXXX-XXXX-XXXX-XXXX --json",
+	},
+	configure: func(fs *flag.FlagSet) func() error {
+		flags := registerCommonFlags(fs)
+		asJSON := fs.Bool("json", false, "Print the status as JSON")
+
+		return func() error {
+			return runStatus(flags, *asJSON)
+		}
+	},
+}
+
+type serverStatus struct {
+	MachineID string                `json:"machine_id"`
+	Host      string                `json:"host,omitempty"`
+	PublicIP  string                `json:"public_ip"`
+	PrivateIP string                `json:"private_ip"`
+	Address   string                `json:"address,omitempty"`
+	Role      string                `json:"role"`
+	Status    string                `json:"status"`
+	Step      types.ServerStep      `json:"step"`
+	Arch      string                `json:"arch,omitempty"`
+	UpdatedAt string                `json:"updated_at"`
+	Health    *manager.HealthReport `json:"health,omitempty"`
+	// Components maps each installed component to the version recorded for it.
+	Components map[string]string `json:"components,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+func runStatus(flags *commonFlags, asJSON bool) error {
+	ctx := context.Background()
+
+	env, err := newEnvironment(ctx, flags)
+	if err != nil {
+		return err
+	}
+	defer env.Close()
+
+	servers, err := env.database.GetAllServers()
+	if err != nil {
+		return fmt.Errorf("failed to get servers: %v", err)
+	}
+
+	components, err := env.database.GetComponents()
+	if err != nil {
+		return err
+	}
+
+	nomadToken, err := manager.ManagementToken(env.database)
+	if err != nil {
+		return err
+	}
+
+	statuses := make([]serverStatus, len(servers))
+
+	var wg sync.WaitGroup
+
+	for i, state := range servers {
+		statuses[i] = serverStatus{
+			MachineID:  shortMachineID(state.MachineID),
+			PublicIP:   state.PublicIP,
+			PrivateIP:  state.PrivateIP,
+			Address:    state.Address,
+			Role:       state.Role,
+			Status:     state.Status,
+			Step:       state.CurrentStep,
+			Arch:       state.Arch,
+			UpdatedAt:  state.UpdatedAt,
+			Components: components[state.MachineID],
+		}
+
+		server, ok := configuredServer(env.config, state)
+		if !ok {
+			statuses[i].Error = "not in config, cannot probe"
+			continue
+		}
+		statuses[i].Host = server.Host
+
+		wg.Add(1)
+
+		go func(status *serverStatus, server types.Server, isServer bool) {
+			defer wg.Done()
+
+			client, err := env.connect(server)
+			if err != nil {
+				status.Error = err.Error()
+				return
+			}
+			defer client.Close()
+
+			health := manager.ProbeHealth(client, isServer, nomadToken)
+			status.Health = &health
+		}(&statuses[i], server, isServerRole(state.Role))
+	}
+
+	wg.Wait()
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(statuses)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "MACHINE\tHOST\tPUBLIC IP\tADDRESS\tROLE\tARCH\tSTATUS\tSTEP\tNOMAD\tSERVERS\tCONSUL LEADER\tRUNNER")
+	for _, status := range statuses {
+		nomad, members, leader, runner := "-", "-", "-", "-"
+		arch, address := status.Arch, status.Address
+		if arch == "" {
+			arch = "-"
+		}
+		if address == "" {
+			address = "-"
+		}
+		if status.Health != nil {
+			nomad = status.Health.NomadAgent
+			leader = status.Health.ConsulLeader
+			runner = status.Health.Runner
+			if isServerRole(status.Role) {
+				members = fmt.Sprint(status.Health.NomadServers)
+			}
+		} else if status.Error != "" {
+			nomad = "unreachable"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			status.MachineID,
+			status.Host,
+			status.PublicIP,
+			address,
+			status.Role,
+			arch,
+			status.Status,
+			status.Step,
+			nomad,
+			members,
+			leader,
+			runner,
+		)
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for _, status := range statuses {
+		if status.Error != "" {
+			fmt.Printf("%s: %s\n", status.MachineID, status.Error)
+		}
+	}
+
+	printVersionSkew(statuses)
+
+	return nil
+}
+
+// printVersionSkew lists every component recorded at more than one version across the servers.
+func printVersionSkew(statuses []serverStatus) {
+	hostsByVersion := make(map[string]map[string][]string)
+	for _, status := range statuses {
+		for component, version := range status.Components {
+			if hostsByVersion[component] == nil {
+				hostsByVersion[component] = make(map[string][]string)
+			}
+			hostsByVersion[component][version] = append(hostsByVersion[component][version], status.MachineID)
+		}
+	}
+
+	var skewed []string
+	for component, versions := range hostsByVersion {
+		if len(versions) > 1 {
+			skewed = append(skewed, component)
+		}
+	}
+	if len(skewed) == 0 {
+		return
+	}
+	sort.Strings(skewed)
+
+	fmt.Println("\nVersion skew:")
+	for _, component := range skewed {
+		for version, machines := range hostsByVersion[component] {
+			fmt.Printf("  %s %s: %s\n", component, version, strings.Join(machines, ", "))
+		}
+	}
+}
+
+// configuredServer finds the config entry, and with it the SSH details, for a server recorded in the database.
+func configuredServer(config *types.Config, state types.ServerState) (types.Server, bool) {
+	for _, server := range config.Servers {
+		if server.PrivateIP == state.PrivateIP {
+			return server, true
+		}
+	}
+	return types.Server{}, false
+}
+
+func isServerRole(role string) bool {
+	return role == "server" || role == "both"
+}
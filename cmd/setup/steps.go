@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/brimblehq/migration/internal/manager"
+	"github.com/brimblehq/migration/internal/pipeline"
+	"github.com/brimblehq/migration/internal/retry"
+	"github.com/brimblehq/migration/internal/types"
+)
+
+// stepSequence is every step a host's progress can be recorded as, in pipeline order.
+var stepSequence = provisioningPipeline(nil, "", "", "", nil).Sequence()
+
+var stepOrder = func() map[types.ServerStep]int {
+	order := make(map[types.ServerStep]int, len(stepSequence))
+	for i, step := range stepSequence {
+		order[step] = i
+	}
+	return order
+}()
+
+// provisioningPipeline binds the setup steps to one host. New steps are added
+// here; the orchestration in provisionHost does not change. r holds the host
+// back until the cluster is ready; without one, nothing waits.
+func provisioningPipeline(im *manager.InstallationManager, machineID, licenseKey, instances string, r *rollout) *pipeline.Pipeline {
+	return pipeline.New(types.StepInitialized, types.StepCompleted).MustAdd(
+		pipeline.Step{
+			Name:    "Verifying machine requirements",
+			ID:      types.StepVerified,
+			Timeout: 2 * time.Minute,
+			Retry:   retry.Fixed(2, 5*time.Second),
+			Run:     im.VerifyMachineRequirement,
+			Plan:    func() ([]string, error) { return im.PlanVerifyMachineRequirement(), nil },
+		},
+		pipeline.Step{
+			Name:      "Installing base packages",
+			ID:        types.StepBaseInstalled,
+			DependsOn: []types.ServerStep{types.StepVerified},
+			Timeout:   45 * time.Minute,
+			Run:       func(ctx context.Context) error { return im.InstallBasePackages(ctx, machineID) },
+			Plan:      func() ([]string, error) { return im.PlanBasePackages(), nil },
+		},
+		pipeline.Step{
+			Name:      "Setting up Consul client",
+			ID:        types.StepConsulSetup,
+			DependsOn: []types.ServerStep{types.StepBaseInstalled},
+			Timeout:   10 * time.Minute,
+			Run:       func(ctx context.Context) error { return im.SetupConsulClient(ctx, machineID) },
+			Rollback:  func(context.Context) error { return im.RemoveConsulClient() },
+			Plan:      func() ([]string, error) { return im.PlanConsulClient(machineID) },
+		},
+		pipeline.Step{
+			Name:      "Setting up Nomad",
+			ID:        types.StepNomadSetup,
+			DependsOn: []types.ServerStep{types.StepConsulSetup},
+			Timeout:   15 * time.Minute,
+			Wait: func(ctx context.Context) error {
+				if im.IsServer() {
+					return nil
+				}
+				return r.clusterReady(ctx)
+			},
+			Run:  func(ctx context.Context) error { return im.SetupNomad(ctx) },
+			Plan: func() ([]string, error) { return im.PlanNomad(), nil },
+		},
+		pipeline.Step{
+			Name:      "Setting up monitoring",
+			ID:        types.StepMonitoringSetup,
+			DependsOn: []types.ServerStep{types.StepNomadSetup},
+			Timeout:   15 * time.Minute,
+			Wait:      r.clusterReady,
+			Run:       func(ctx context.Context) error { return r.deployMonitoring(ctx, im) },
+			Plan:      func() ([]string, error) { return im.PlanMonitoring() },
+			Skip:      func() bool { return !im.MonitoringEnabled() },
+		},
+		pipeline.Step{
+			Name:      "Starting runner",
+			ID:        types.StepRunnerStarted,
+			DependsOn: []types.ServerStep{types.StepNomadSetup},
+			Timeout:   10 * time.Minute,
+			Wait:      r.clusterReady,
+			Run:       func(ctx context.Context) error { return im.StartRunner(ctx, licenseKey, instances) },
+			Rollback:  func(context.Context) error { return im.StopRunner() },
+			Plan:      func() ([]string, error) { return im.PlanRunner(licenseKey, instances) },
+		},
+	)
+}
+
+// stepSelection narrows a setup run to part of the pipeline: everything from one
+// step onwards, or a single step.
+type stepSelection struct {
+	from types.ServerStep
+	only types.ServerStep
+}
+
+func parseStepSelection(from, only string) (stepSelection, error) {
+	if from != "" && only != "" {
+		return stepSelection{}, fmt.Errorf("--from-step and --only-step cannot be combined")
+	}
+
+	selection := stepSelection{
+		from: types.ServerStep(from),
+		only: types.ServerStep(only),
+	}
+
+	for _, step := range []types.ServerStep{selection.from, selection.only} {
+		if step == "" {
+			continue
+		}
+		if _, ok := stepOrder[step]; !ok || step == types.StepInitialized || step == types.StepCompleted {
+			return stepSelection{}, fmt.Errorf("unknown step %q, expected one of: %s", step, runnableStepNames())
+		}
+	}
+
+	return selection, nil
+}
+
+func (s stepSelection) target() types.ServerStep {
+	if s.only != "" {
+		return s.only
+	}
+	return s.from
+}
+
+// includes reports whether step should run under this selection.
+func (s stepSelection) includes(step types.ServerStep) bool {
+	return s.only == "" || s.only == step
+}
+
+// rewind returns the step to record before running the selection: the
+// prerequisite of the selected step, or current when no step was selected.
+func (s stepSelection) rewind(current types.ServerStep) (types.ServerStep, error) {
+	target := s.target()
+	if target == "" {
+		return current, nil
+	}
+
+	prerequisite := stepSequence[stepOrder[target]-1]
+	if stepOrder[current] < stepOrder[prerequisite] {
+		return "", fmt.Errorf("cannot run %s: recorded step %s has not reached %s", target, current, prerequisite)
+	}
+
+	return prerequisite, nil
+}
+
+func runnableStepNames() string {
+	var names []string
+	for _, step := range stepSequence[1 : len(stepSequence)-1] {
+		names = append(names, string(step))
+	}
+	return strings.Join(names, ", ")
+}
+
+// selectServers narrows the configured servers to the given hosts, matched by host name or IP.
+func selectServers(servers []types.Server, hosts string) ([]types.Server, error) {
+	if hosts == "" {
+		return servers, nil
+	}
+
+	var selected []types.Server
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+
+		found := false
+		for _, server := range servers {
+			if server.Host == host || server.PublicIP == host || server.PrivateIP == host {
+				selected = append(selected, server)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("host %q is not in the config", host)
+		}
+	}
+
+	return selected, nil
+}
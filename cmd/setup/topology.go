@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/brimblehq/migration/internal/manager"
+	"github.com/brimblehq/migration/internal/types"
+)
+
+// loadTopology returns the cluster topology recorded in the database, extended
+// with any configured servers that are not members yet. Without recorded
+// members, or with --replan, roles are planned from the config. When persist is
+// set, changes are saved so every later run reuses the same roles.
+func loadTopology(env *environment, opts setupOptions, persist bool) (*manager.ClusterManager, error) {
+	topology, err := recordedTopology(env)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := false
+
+	if topology == nil || len(topology.Members) == 0 || opts.replan {
+		topology, err = manager.PlanTopology(env.config.Servers, opts.forceQuorum)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster topology: %v", err)
+		}
+		changed = true
+	}
+
+	extended, err := manager.ExtendTopology(topology, env.config.Servers, opts.forceQuorum)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cluster topology: %v", err)
+	}
+
+	if persist && (changed || extended) {
+		if err := env.database.SaveTopology(topology); err != nil {
+			return nil, err
+		}
+	}
+
+	return manager.NewClusterManager(topology), nil
+}
+
+// recordedTopology reads the saved topology. Clusters provisioned before
+// topologies were saved are rebuilt from the roles in the servers table; nil
+// means nothing has been provisioned yet.
+func recordedTopology(env *environment) (*types.Topology, error) {
+	topology, err := env.database.GetTopology()
+	if err != nil || topology != nil {
+		return topology, err
+	}
+
+	existingServers, err := env.database.GetAllServers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing servers: %v", err)
+	}
+
+	topology = &types.Topology{}
+	for _, state := range existingServers {
+		if state.Status != "active" {
+			continue
+		}
+
+		server, ok := configuredServer(env.config, state)
+		if !ok {
+			server = types.Server{
+				Host:      state.PublicIP,
+				PublicIP:  state.PublicIP,
+				PrivateIP: state.PrivateIP,
+			}
+		}
+
+		topology.Members = append(topology.Members, types.ClusterMember{
+			Server: server,
+			Roles:  manager.RolesFromName(state.Role),
+		})
+	}
+
+	if len(topology.Members) == 0 {
+		return nil, nil
+	}
+
+	return topology, nil
+}
+
+// forgetMember removes a decommissioned server from the saved topology.
+func forgetMember(env *environment, privateIP string) error {
+	topology, err := env.database.GetTopology()
+	if err != nil || topology == nil {
+		return err
+	}
+
+	if !manager.RemoveMember(topology, privateIP) {
+		return nil
+	}
+
+	return env.database.SaveTopology(topology)
+}
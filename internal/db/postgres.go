@@ -13,11 +13,14 @@ import (
 )
 
 type PostgresDB struct {
-	db *sql.DB
+	db        *sql.DB
+	secretKey string
 }
 
 type Config struct {
 	URI string
+	// SecretKey encrypts the secrets stored with SaveSecret.
+	SecretKey string
 }
 
 type TempSSHKey struct {
@@ -44,7 +47,13 @@ func NewPostgresDB(config Config) (*PostgresDB, error) {
 		return nil, fmt.Errorf("error pinging database: %v", err)
 	}
 
-	return &PostgresDB{db: db}, nil
+	postgres := &PostgresDB{db: db, secretKey: config.SecretKey}
+
+	if err := postgres.migrate(); err != nil {
+		return nil, err
+	}
+
+	return postgres, nil
 }
 
 func (p *PostgresDB) Close() error {
@@ -140,6 +149,62 @@ func (p *PostgresDB) UpdateServerStep(machineID string, step types.ServerStep) e
 	return tx.Commit()
 }
 
+func (p *PostgresDB) UpdateServerStatus(machineID, status string) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("SELECT pg_advisory_xact_lock($1)", hashString(machineID))
+	if err != nil {
+		return fmt.Errorf("failed to acquire lock: %v", err)
+	}
+
+	query := `
+        UPDATE servers
+        SET status = $1, updated_at = $2
+        WHERE machine_id = $3
+    `
+
+	_, err = tx.Exec(query, status, time.Now(), machineID)
+	if err != nil {
+		return fmt.Errorf("failed to update status: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+func (p *PostgresDB) UpdateServerArch(machineID, arch string) error {
+	query := `
+        UPDATE servers
+        SET arch = $1, updated_at = $2
+        WHERE machine_id = $3
+    `
+
+	_, err := p.db.Exec(query, arch, time.Now(), machineID)
+	if err != nil {
+		return fmt.Errorf("failed to update architecture: %v", err)
+	}
+
+	return nil
+}
+
+func (p *PostgresDB) UpdateServerAddress(machineID, address string) error {
+	query := `
+        UPDATE servers
+        SET address = $1, updated_at = $2
+        WHERE machine_id = $3
+    `
+
+	_, err := p.db.Exec(query, address, time.Now(), machineID)
+	if err != nil {
+		return fmt.Errorf("failed to update address: %v", err)
+	}
+
+	return nil
+}
+
 func hashString(s string) int64 {
 	h := fnv.New64a()
 	h.Write([]byte(s))
@@ -165,7 +230,7 @@ func (p *PostgresDB) IsServerRegistered(machineID string) (bool, error) {
 
 func (p *PostgresDB) GetAllServers() ([]types.ServerState, error) {
 	query := `
-        SELECT id, machine_id, public_ip, private_ip, role, status, created_at, updated_at
+        SELECT id, machine_id, public_ip, private_ip, role, status, step, arch, address, created_at, updated_at
         FROM servers
         WHERE status = 'active'
         ORDER BY created_at ASC
@@ -187,6 +252,9 @@ func (p *PostgresDB) GetAllServers() ([]types.ServerState, error) {
 			&server.PrivateIP,
 			&server.Role,
 			&server.Status,
+			&server.CurrentStep,
+			&server.Arch,
+			&server.Address,
 			&server.CreatedAt,
 			&server.UpdatedAt,
 		)
@@ -199,6 +267,38 @@ func (p *PostgresDB) GetAllServers() ([]types.ServerState, error) {
 	return servers, nil
 }
 
+func (p *PostgresDB) GetServer(machineID string) (*types.ServerState, error) {
+	query := `
+        SELECT id, machine_id, public_ip, private_ip, role, status, identifier, step, arch, address, created_at, updated_at
+        FROM servers
+        WHERE machine_id = $1
+    `
+
+	var server types.ServerState
+	err := p.db.QueryRow(query, machineID).Scan(
+		&server.ID,
+		&server.MachineID,
+		&server.PublicIP,
+		&server.PrivateIP,
+		&server.Role,
+		&server.Status,
+		&server.Identifier,
+		&server.CurrentStep,
+		&server.Arch,
+		&server.Address,
+		&server.CreatedAt,
+		&server.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying server: %v", err)
+	}
+
+	return &server, nil
+}
+
 func (p *PostgresDB) GetServerStep(machineID string, identifier string) (types.ServerStep, error) {
 	var step types.ServerStep
 	query := `SELECT step FROM servers WHERE machine_id = $1 AND identifier = $2`
@@ -206,6 +306,96 @@ func (p *PostgresDB) GetServerStep(machineID string, identifier string) (types.S
 	return step, err
 }
 
+func (p *PostgresDB) GetTopology() (*types.Topology, error) {
+	var topologyJSON []byte
+	var updatedAt time.Time
+
+	err := p.db.QueryRow(`SELECT topology, updated_at FROM cluster_topology WHERE id = 1`).Scan(&topologyJSON, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying topology: %v", err)
+	}
+
+	var topology types.Topology
+	if err := json.Unmarshal(topologyJSON, &topology); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal topology: %w", err)
+	}
+	topology.UpdatedAt = updatedAt.Format(time.RFC3339)
+
+	return &topology, nil
+}
+
+func (p *PostgresDB) SaveTopology(topology *types.Topology) error {
+	topologyJSON, err := json.Marshal(topology)
+	if err != nil {
+		return fmt.Errorf("failed to marshal topology: %w", err)
+	}
+
+	query := `
+        INSERT INTO cluster_topology (id, topology, updated_at)
+        VALUES (1, $1, $2)
+        ON CONFLICT (id) DO UPDATE
+        SET topology = $1, updated_at = $2
+    `
+
+	if _, err := p.db.Exec(query, topologyJSON, time.Now()); err != nil {
+		return fmt.Errorf("failed to save topology: %v", err)
+	}
+
+	return nil
+}
+
+// RecordComponent checkpoints one installed base component and the version it reported.
+func (p *PostgresDB) RecordComponent(machineID, component, version string) error {
+	query := `
+        INSERT INTO server_components (machine_id, component, version, installed_at)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (machine_id, component) DO UPDATE
+        SET version = $3, installed_at = $4
+    `
+
+	if _, err := p.db.Exec(query, machineID, component, version, time.Now()); err != nil {
+		return fmt.Errorf("failed to record component %s: %v", component, err)
+	}
+
+	return nil
+}
+
+// GetComponents returns the recorded component versions of every server, keyed by machine ID and component.
+func (p *PostgresDB) GetComponents() (map[string]map[string]string, error) {
+	rows, err := p.db.Query(`SELECT machine_id, component, version FROM server_components`)
+	if err != nil {
+		return nil, fmt.Errorf("error querying components: %v", err)
+	}
+	defer rows.Close()
+
+	components := make(map[string]map[string]string)
+	for rows.Next() {
+		var machineID, component, version string
+		if err := rows.Scan(&machineID, &component, &version); err != nil {
+			return nil, fmt.Errorf("error scanning component row: %v", err)
+		}
+
+		if components[machineID] == nil {
+			components[machineID] = make(map[string]string)
+		}
+		components[machineID][component] = version
+	}
+
+	return components, rows.Err()
+}
+
+// ClearComponents forgets the components recorded for a server, after they are uninstalled.
+func (p *PostgresDB) ClearComponents(machineID string) error {
+	if _, err := p.db.Exec(`DELETE FROM server_components WHERE machine_id = $1`, machineID); err != nil {
+		return fmt.Errorf("failed to clear components: %v", err)
+	}
+
+	return nil
+}
+
 func (p *PostgresDB) CreateTempSSHKey(ctx context.Context, keyID, publicKey string, servers []string) (*TempSSHKey, error) {
 	serversJSON, err := json.Marshal(servers)
 	if err != nil {
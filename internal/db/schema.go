@@ -0,0 +1,36 @@
+package db
+
+import "fmt"
+
+// migrations create the tables and columns added on top of the servers and
+// temp_ssh_keys tables. Each statement must be safe to run on every start.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS cluster_topology (
+        id INTEGER PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+        topology JSONB NOT NULL,
+        updated_at TIMESTAMP NOT NULL
+    )`,
+	`CREATE TABLE IF NOT EXISTS server_components (
+        machine_id TEXT NOT NULL,
+        component TEXT NOT NULL,
+        version TEXT NOT NULL,
+        installed_at TIMESTAMP NOT NULL,
+        PRIMARY KEY (machine_id, component)
+    )`,
+	`ALTER TABLE servers ADD COLUMN IF NOT EXISTS arch TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE servers ADD COLUMN IF NOT EXISTS address TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE IF NOT EXISTS cluster_secrets (
+        name TEXT PRIMARY KEY,
+        value TEXT NOT NULL,
+        updated_at TIMESTAMP NOT NULL
+    )`,
+}
+
+func (p *PostgresDB) migrate() error {
+	for _, statement := range migrations {
+		if _, err := p.db.Exec(statement); err != nil {
+			return fmt.Errorf("failed to apply migration: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+// SaveSecret stores value under name, encrypted with AES-GCM under a key
+// derived from Config.SecretKey.
+func (p *PostgresDB) SaveSecret(name, value string) error {
+	gcm, err := p.secretCipher()
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	sealed := base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(value), []byte(name)))
+
+	query := `
+        INSERT INTO cluster_secrets (name, value, updated_at)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (name) DO UPDATE
+        SET value = $2, updated_at = $3
+    `
+
+	if _, err := p.db.Exec(query, name, sealed, time.Now()); err != nil {
+		return fmt.Errorf("failed to save secret %s: %v", name, err)
+	}
+
+	return nil
+}
+
+// GetSecret returns the decrypted secret stored under name, or "" if there is none.
+func (p *PostgresDB) GetSecret(name string) (string, error) {
+	var sealed string
+	err := p.db.QueryRow(`SELECT value FROM cluster_secrets WHERE name = $1`, name).Scan(&sealed)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error querying secret %s: %v", name, err)
+	}
+
+	gcm, err := p.secretCipher()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("secret %s is corrupt", name)
+	}
+
+	value, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret %s, was it stored under another license key? %v", name, err)
+	}
+
+	return string(value), nil
+}
+
+// DeleteSecret removes the secret stored under name, if any.
+func (p *PostgresDB) DeleteSecret(name string) error {
+	if _, err := p.db.Exec(`DELETE FROM cluster_secrets WHERE name = $1`, name); err != nil {
+		return fmt.Errorf("failed to delete secret %s: %v", name, err)
+	}
+	return nil
+}
+
+func (p *PostgresDB) secretCipher() (cipher.AEAD, error) {
+	if p.secretKey == "" {
+		return nil, fmt.Errorf("no secret key configured for the state database")
+	}
+
+	key := sha256.Sum256([]byte(p.secretKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
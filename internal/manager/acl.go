@@ -0,0 +1,312 @@
+package manager
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/brimblehq/migration/internal/db"
+	"github.com/brimblehq/migration/internal/ssh"
+)
+
+// Secret names the Nomad ACL tokens are stored under in the state database.
+const (
+	nomadManagementSecret = "nomad_management_token"
+	nomadRunnerSecret     = "nomad_runner_token"
+	nomadMonitoringSecret = "nomad_monitoring_token"
+)
+
+// nomadPolicy is a scoped ACL policy; a client token holding only it is
+// created and stored under secret.
+type nomadPolicy struct {
+	name        string
+	secret      string
+	description string
+	rules       string
+}
+
+var nomadPolicies = []nomadPolicy{
+	{
+		name:        "brimble-runner",
+		secret:      nomadRunnerSecret,
+		description: "Brimble runner: deploys and manages application jobs",
+		rules: `namespace "*" {
+	policy = "write"
+}
+
+node {
+	policy = "read"
+}
+
+agent {
+	policy = "read"
+}
+`,
+	},
+	{
+		name:        "brimble-monitoring",
+		secret:      nomadMonitoringSecret,
+		description: "Brimble monitoring: deploys the monitoring jobs",
+		rules: `namespace "default" {
+	policy = "write"
+}
+
+node {
+	policy = "read"
+}
+
+agent {
+	policy = "read"
+}
+`,
+	},
+}
+
+const (
+	nomadBootstrapCmd = "nomad acl bootstrap -json 2>&1 || true"
+	nomadTokenSelfCmd = "nomad acl token self 2>&1 || true"
+)
+
+// aclEnabled reports whether the cluster runs Nomad with ACLs.
+func (im *InstallationManager) aclEnabled() bool {
+	return im.config.ClusterConfig.ACL
+}
+
+// BootstrapACL bootstraps Nomad's ACL system through this host's agent and
+// stores the management token, then creates the scoped policies and tokens
+// that are not stored yet. It does nothing when ACLs are off, and only the
+// missing pieces when it runs again. A stored management token the cluster
+// rejects, as it does once the Nomad state was wiped by re-running the Nomad
+// step, is dropped with the scoped tokens and the cluster bootstrapped again.
+func (im *InstallationManager) BootstrapACL() error {
+	if !im.aclEnabled() {
+		return nil
+	}
+
+	management, err := im.DB.GetSecret(nomadManagementSecret)
+	if err != nil {
+		return err
+	}
+
+	if err := writeNomadToken(im.sshClient, management); err != nil {
+		return err
+	}
+
+	if management != "" {
+		rejected, err := im.tokenRejected(management)
+		if err != nil {
+			return err
+		}
+		if rejected {
+			log.Printf("Stored Nomad management token was rejected, bootstrapping ACLs again")
+			if err := ForgetNomadTokens(im.DB); err != nil {
+				return err
+			}
+			management = ""
+		}
+	}
+
+	if management == "" {
+		output, err := im.sshClient.ExecuteCommandWithOutput(nomadBootstrapCmd)
+		if err != nil {
+			return fmt.Errorf("failed to bootstrap nomad ACLs: %v", err)
+		}
+
+		if management, err = aclSecretID(output); err != nil {
+			if strings.Contains(output, "already done") {
+				return fmt.Errorf("nomad ACLs were bootstrapped outside setup and the management token is not in the state database; reset the ACL bootstrap on the leader and run setup again")
+			}
+			return fmt.Errorf("failed to bootstrap nomad ACLs: %s", strings.TrimSpace(output))
+		}
+
+		if err := im.DB.SaveSecret(nomadManagementSecret, management); err != nil {
+			return err
+		}
+		if err := writeNomadToken(im.sshClient, management); err != nil {
+			return err
+		}
+	}
+
+	for _, policy := range nomadPolicies {
+		token, err := im.DB.GetSecret(policy.secret)
+		if err != nil {
+			return err
+		}
+		if token != "" {
+			continue
+		}
+
+		if token, err = im.createScopedToken(management, policy); err != nil {
+			return err
+		}
+		if err := im.DB.SaveSecret(policy.secret, token); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tokenRejected reports whether the cluster refuses token. An error means the
+// cluster could not answer, for example while it has no leader.
+func (im *InstallationManager) tokenRejected(token string) (bool, error) {
+	output, err := im.sshClient.ExecuteCommandWithOutput(withNomadToken(token, nomadTokenSelfCmd))
+	if err != nil {
+		return false, fmt.Errorf("failed to check nomad token: %v", err)
+	}
+
+	switch {
+	case strings.Contains(output, "Accessor ID"):
+		return false, nil
+	case strings.Contains(output, "ACL token not found"), strings.Contains(output, "Permission denied"), strings.Contains(output, "403"):
+		return true, nil
+	default:
+		return false, fmt.Errorf("failed to check nomad token: %s", strings.TrimSpace(output))
+	}
+}
+
+// createScopedToken applies policy and returns the secret of a new client
+// token that holds only it.
+func (im *InstallationManager) createScopedToken(management string, policy nomadPolicy) (string, error) {
+	policyFile := fmt.Sprintf("/tmp/%s.policy.hcl", policy.name)
+	if err := im.sshClient.WriteFile(policyFile, []byte(policy.rules), ssh.FileOptions{Mode: 0600}); err != nil {
+		return "", fmt.Errorf("failed to write policy %s: %v", policy.name, err)
+	}
+	defer im.sshClient.ExecuteCommand("rm -f " + policyFile)
+
+	applyCmd := fmt.Sprintf("nomad acl policy apply -description %q %s %s", policy.description, policy.name, policyFile)
+	if err := im.sshClient.ExecuteCommand(withNomadToken(management, applyCmd)); err != nil {
+		return "", fmt.Errorf("failed to apply policy %s: %v", policy.name, err)
+	}
+
+	createCmd := fmt.Sprintf("nomad acl token create -name=%s -policy=%s -type=client -json", policy.name, policy.name)
+	output, err := im.sshClient.ExecuteCommandWithOutput(withNomadToken(management, createCmd))
+	if err != nil {
+		return "", fmt.Errorf("failed to create token for %s: %v", policy.name, err)
+	}
+
+	token, err := aclSecretID(output)
+	if err != nil {
+		return "", fmt.Errorf("failed to create token for %s: %v", policy.name, err)
+	}
+	return token, nil
+}
+
+// aclSecretID reads the secret of a token printed by the nomad CLI with -json.
+func aclSecretID(output string) (string, error) {
+	var token struct {
+		SecretID string
+	}
+	if err := json.Unmarshal([]byte(output), &token); err != nil || token.SecretID == "" {
+		return "", fmt.Errorf("no token in nomad output")
+	}
+	return token.SecretID, nil
+}
+
+// nomadToken returns the stored token for secret, which the host's steps need
+// once the cluster is ready. Only BootstrapACL, run once the servers elect a
+// leader, creates tokens; a missing one is an error. It is empty when ACLs
+// are off.
+func (im *InstallationManager) nomadToken(secret string) (string, error) {
+	token, err := im.storedNomadToken(secret)
+	if err != nil {
+		return "", err
+	}
+	if token == "" && im.aclEnabled() {
+		return "", fmt.Errorf("no %s is stored: nomad ACLs have not been bootstrapped, wait for the Nomad servers to elect a leader", strings.ReplaceAll(secret, "_", " "))
+	}
+	return token, nil
+}
+
+// storedNomadToken returns the stored token for secret without bootstrapping,
+// and places it on the host for withNomadToken. It is empty when ACLs are off
+// or not bootstrapped yet, such as while the servers are still coming up.
+func (im *InstallationManager) storedNomadToken(secret string) (string, error) {
+	if !im.aclEnabled() || im.DB == nil {
+		return "", nil
+	}
+
+	token, err := im.DB.GetSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	if err := writeNomadToken(im.sshClient, token); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// managementToken is the stored management token for the operator commands
+// setup and teardown run.
+func (im *InstallationManager) managementToken() (string, error) {
+	return im.storedNomadToken(nomadManagementSecret)
+}
+
+// ManagementToken returns the stored Nomad management token, or "" when ACLs
+// have not been bootstrapped.
+func ManagementToken(database *db.PostgresDB) (string, error) {
+	return database.GetSecret(nomadManagementSecret)
+}
+
+// ForgetNomadTokens drops the stored ACL tokens once the cluster they belong
+// to is gone, so the next setup bootstraps a fresh one.
+func ForgetNomadTokens(database *db.PostgresDB) error {
+	for _, secret := range []string{nomadManagementSecret, nomadRunnerSecret, nomadMonitoringSecret} {
+		if err := database.DeleteSecret(secret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// planWithToken is withNomadToken as plans show it: the env file is named
+// after the token, which is not known when planning.
+func (im *InstallationManager) planWithToken(name, command string) string {
+	if !im.aclEnabled() {
+		return command
+	}
+	return fmt.Sprintf("set -a; . ./<%s token file>; set +a; %s", name, command)
+}
+
+// tokenFileNote is the plan line for writeNomadToken.
+func tokenFileNote(name string) string {
+	return fmt.Sprintf("# write the stored %s token to %s (mode 0600) in the SSH user's home", name, nomadTokenFiles)
+}
+
+// nomadTokenFiles matches the files writeNomadToken leaves in the SSH user's
+// home directory.
+const nomadTokenFiles = ".nomad-token-*.env"
+
+// nomadTokenFile is where writeNomadToken keeps token on the host, relative
+// to the SSH user's home directory. Each token has its own file, so commands
+// running with different tokens at once do not overwrite each other's.
+func nomadTokenFile(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return fmt.Sprintf(".nomad-token-%x.env", sum[:6])
+}
+
+// writeNomadToken places token on the host in an env file only the SSH user
+// can read, so it never appears on a command line. It does nothing for an
+// empty token or without a client, as when planning.
+func writeNomadToken(client *ssh.SSHClient, token string) error {
+	if token == "" || client == nil {
+		return nil
+	}
+
+	data := []byte("NOMAD_TOKEN=" + token + "\n")
+	if err := client.WriteFile(nomadTokenFile(token), data, ssh.FileOptions{Mode: 0600}); err != nil {
+		return fmt.Errorf("failed to write nomad token: %v", err)
+	}
+	return nil
+}
+
+// withNomadToken runs a nomad CLI command with token, which writeNomadToken
+// must have placed on the host; an empty token leaves the command as it is.
+func withNomadToken(token, command string) string {
+	if token == "" {
+		return command
+	}
+	return fmt.Sprintf("set -a; . ./%s; set +a; %s", nomadTokenFile(token), command)
+}
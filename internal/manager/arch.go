@@ -0,0 +1,147 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/brimblehq/migration/internal/ssh"
+)
+
+const archCommand = "uname -m"
+
+// architectures maps what `uname -m` reports to the names artifacts and images
+// are published under.
+var architectures = map[string]string{
+	"x86_64":  "amd64",
+	"amd64":   "amd64",
+	"aarch64": "arm64",
+	"arm64":   "arm64",
+}
+
+// Architecture detects the host's CPU architecture once per manager, as amd64
+// or arm64. Without an SSH client, as when planning a host InspectHost could
+// not reach, amd64 is assumed.
+func (im *InstallationManager) Architecture() (string, error) {
+	if im.arch != "" {
+		return im.arch, nil
+	}
+	if im.sshClient == nil {
+		return "amd64", nil
+	}
+
+	arch, err := readArchitecture(im.sshClient)
+	if err != nil {
+		return "", err
+	}
+
+	im.arch = arch
+	return arch, nil
+}
+
+func readArchitecture(client *ssh.SSHClient) (string, error) {
+	output, err := client.ExecuteCommandWithOutput(archCommand)
+	if err != nil {
+		return "", fmt.Errorf("failed to detect architecture: %v", err)
+	}
+
+	machine := strings.TrimSpace(output)
+	arch, ok := architectures[machine]
+	if !ok {
+		return "", fmt.Errorf("unsupported architecture %s: hosts must be x86_64 or aarch64", machine)
+	}
+	return arch, nil
+}
+
+func runnerURL(arch string) string {
+	if arch == "arm64" {
+		return "https://cdn.brimble.io/runner-linux-arm64"
+	}
+	return "https://cdn.brimble.io/runner-linux"
+}
+
+// clusterArchitectures lists the architectures recorded for active servers,
+// along with this host's.
+func (im *InstallationManager) clusterArchitectures() ([]string, error) {
+	arch, err := im.Architecture()
+	if err != nil {
+		return nil, err
+	}
+
+	found := map[string]bool{arch: true}
+	if im.DB != nil {
+		servers, err := im.DB.GetAllServers()
+		if err != nil {
+			return nil, err
+		}
+		for _, server := range servers {
+			if server.Arch != "" {
+				found[server.Arch] = true
+			}
+		}
+	}
+
+	var archs []string
+	for arch := range found {
+		archs = append(archs, arch)
+	}
+	sort.Strings(archs)
+	return archs, nil
+}
+
+var imagePattern = regexp.MustCompile(`(?m)^\s*image\s*=\s*"([^"]+)"`)
+
+func jobImages(jobContent string) []string {
+	var images []string
+	for _, match := range imagePattern.FindAllStringSubmatch(jobContent, -1) {
+		images = append(images, match[1])
+	}
+	return images
+}
+
+func manifestCommand(image string) string {
+	return fmt.Sprintf("docker manifest inspect %s", image)
+}
+
+// checkImagePlatforms makes sure every image in a job is published for each
+// architecture in the cluster, so the job can be placed on any node.
+func (im *InstallationManager) checkImagePlatforms(jobName, jobContent string, archs []string) error {
+	for _, image := range jobImages(jobContent) {
+		output, err := im.sshClient.ExecuteCommandWithOutput(manifestCommand(image))
+		if err != nil {
+			return fmt.Errorf("failed to inspect image %s in %s: %v", image, jobName, err)
+		}
+
+		var manifest struct {
+			Manifests []struct {
+				Platform struct {
+					Architecture string `json:"architecture"`
+				} `json:"platform"`
+			} `json:"manifests"`
+		}
+		if err := json.Unmarshal([]byte(output), &manifest); err != nil {
+			return fmt.Errorf("failed to parse manifest of %s: %v", image, err)
+		}
+
+		published := make(map[string]bool)
+		for _, m := range manifest.Manifests {
+			published[m.Platform.Architecture] = true
+		}
+
+		// A single-platform image does not say which platform it is for, so it
+		// is only trusted on amd64-only clusters.
+		if len(manifest.Manifests) == 0 {
+			published["amd64"] = true
+		}
+
+		for _, arch := range archs {
+			if !published[arch] {
+				return fmt.Errorf("image %s in %s is not published for %s, which hosts in this cluster run", image, jobName, arch)
+			}
+		}
+	}
+
+	return nil
+}
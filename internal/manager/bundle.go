@@ -0,0 +1,592 @@
+package manager
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/brimblehq/migration/internal/ssh"
+	"github.com/brimblehq/migration/internal/types"
+)
+
+// An offline bundle holds every package, binary and image the base components
+// need, so hosts without internet access install entirely from it. Bundles are
+// built per OS family and architecture on a machine with Docker and internet
+// access for one distribution release, and unpacked on each host under
+// bundleDir.
+
+const (
+	bundleDir          = "/opt/brimble/bundle"
+	bundleManifestName = "bundle.json"
+	bundleUpload       = "/tmp/brimble-bundle.tar.gz"
+)
+
+type bundleManifest struct {
+	ID string `json:"id"`
+	// OS is the osFamily name the packages were resolved for.
+	OS     string `json:"os"`
+	Distro string `json:"distro"`
+	// DistroID and VersionID are the ID and VERSION_ID of the distribution's
+	// /etc/os-release; packages are only installed on the same release.
+	DistroID  string         `json:"distro_id"`
+	VersionID string         `json:"version_id"`
+	Arch      string         `json:"arch"`
+	Versions  types.Versions `json:"versions"`
+	Images    []string       `json:"images"`
+	BuiltAt   time.Time      `json:"built_at"`
+
+	// path is where the bundle was read from locally.
+	path string
+}
+
+// BundleOptions select the platform a bundle is built for.
+type BundleOptions struct {
+	Arch string
+	// Distro is a container image of the target distribution, such as
+	// "ubuntu:22.04"; its package manager resolves the packages.
+	Distro string
+	// Output is where the tarball is written; {os} expands to the
+	// distribution and release, such as ubuntu-22.04, and {arch} to Arch.
+	Output string
+}
+
+// bundlePackages are the packages each component installs from the bundle,
+// downloaded into packages/<component>.
+type bundlePackages struct {
+	component string
+	packages  []string
+}
+
+func packagesFor(host osFamily, versions types.Versions) []bundlePackages {
+	nomad := "nomad"
+	if pinned(versions.Nomad) {
+		nomad = host.pin("nomad", versions.Nomad)
+	}
+
+	return []bundlePackages{
+		{"system", append(append([]string{}, host.tools...), host.firewall)},
+		{"docker", host.dockerPackages(versions.Docker)},
+		{"nodejs", []string{"nodejs"}},
+		{"redis", []string{host.redisPackage}},
+		{"infisical", []string{"infisical"}},
+		{"nomad", []string{nomad, "consul-cni"}},
+	}
+}
+
+// expandBundlePath fills the {os} and {arch} placeholders of a bundle path;
+// osName is the release, such as ubuntu-22.04.
+func expandBundlePath(path, osName, arch string) string {
+	return strings.NewReplacer("{os}", osName, "{arch}", arch).Replace(path)
+}
+
+// unameArch is arch as `uname -m` reports it, which some releases are named by.
+func unameArch(arch string) string {
+	if arch == "arm64" {
+		return "aarch64"
+	}
+	return "x86_64"
+}
+
+func cniURL(version, arch string) string {
+	return fmt.Sprintf("https://github.com/containernetworking/plugins/releases/download/%[1]s/cni-plugins-linux-%[2]s-%[1]s.tgz", version, arch)
+}
+
+func tailscaleURL(version, arch string) string {
+	return fmt.Sprintf("https://pkgs.tailscale.com/stable/tailscale_%s_%s.tgz", version, arch)
+}
+
+func nixpacksURL(version, arch string) string {
+	return fmt.Sprintf("https://github.com/railwayapp/nixpacks/releases/download/v%[1]s/nixpacks-v%[1]s-%[2]s-unknown-linux-musl.tar.gz", version, unameArch(arch))
+}
+
+// tailscaleCommands install the binaries and systemd unit from a Tailscale
+// static release archive and start tailscaled.
+func tailscaleCommands(archive, version, arch string) []string {
+	dir := fmt.Sprintf("/tmp/tailscale_%s_%s", version, arch)
+	return []string{
+		"tar -C /tmp -xzf " + archive,
+		"sudo install -m 0755 " + dir + "/tailscale /usr/bin/tailscale",
+		"sudo install -m 0755 " + dir + "/tailscaled /usr/sbin/tailscaled",
+		"sudo install -m 0644 " + dir + "/systemd/tailscaled.service /etc/systemd/system/tailscaled.service",
+		"sudo install -m 0644 " + dir + "/systemd/tailscaled.defaults /etc/default/tailscaled",
+		"sudo systemctl daemon-reload",
+		"sudo systemctl enable --now tailscaled",
+		"rm -rf " + dir,
+	}
+}
+
+// bundleDownloads maps paths inside the bundle to the release URLs they are fetched from.
+func bundleDownloads(host osFamily, versions types.Versions, arch string) [][2]string {
+	nodeArch := "x64"
+	if arch == "arm64" {
+		nodeArch = "arm64"
+	}
+
+	downloads := [][2]string{
+		{"bin/runner", runnerURL(arch)},
+		{"archives/cni-plugins.tgz", cniURL(versions.CNI, arch)},
+		{"archives/node.tar.gz", fmt.Sprintf("https://nodejs.org/dist/v%[1]s/node-v%[1]s-linux-%[2]s.tar.gz", versions.Node, nodeArch)},
+		{"archives/tailscale.tgz", tailscaleURL(versions.Tailscale, arch)},
+		{"archives/nixpacks.tar.gz", nixpacksURL(versions.Nixpacks, arch)},
+	}
+
+	if host.name == amazonFamily.name {
+		downloads = append(downloads, [2]string{"bin/docker-compose", composeURL(versions.Compose, arch)})
+	}
+
+	return downloads
+}
+
+// bundleImages lists the Consul image and every image in the embedded
+// monitoring jobs.
+func (im *InstallationManager) bundleImages() ([]string, error) {
+	var images []string
+	if image := im.consulImage(); image != "" {
+		images = append(images, image)
+	}
+
+	jobs, err := im.monitoringJobs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, jobName := range jobs {
+		jobContent, err := im.files.ReadFile(filepath.Join("monitoring", jobName))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read job file %s: %v", jobName, err)
+		}
+		images = append(images, jobImages(string(jobContent))...)
+	}
+
+	return images, nil
+}
+
+// BuildBundle collects the packages, binaries and images for the configured
+// versions into a tarball and returns its path. It runs locally and needs
+// Docker; building for another architecture needs QEMU emulation.
+func (im *InstallationManager) BuildBundle(ctx context.Context, opts BundleOptions) (string, error) {
+	if opts.Arch != "amd64" && opts.Arch != "arm64" {
+		return "", fmt.Errorf("unsupported architecture %q: use amd64 or arm64", opts.Arch)
+	}
+	platform := "linux/" + opts.Arch
+	versions := im.versions()
+
+	fetch := im.fetcher()
+	if fetch.err != nil {
+		return "", fetch.err
+	}
+	if !fetch.verified() {
+		fmt.Println("Warning: " + unverifiedNote)
+	}
+
+	osRelease, err := runLocal(ctx, "docker", "run", "--rm", "--platform", platform, opts.Distro, "cat", "/etc/os-release")
+	if err != nil {
+		return "", err
+	}
+	host, err := detectOSFamily(osRelease)
+	if err != nil {
+		return "", err
+	}
+
+	images, err := im.bundleImages()
+	if err != nil {
+		return "", err
+	}
+
+	work, err := os.MkdirTemp("", "brimble-bundle-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create work directory: %v", err)
+	}
+	defer os.RemoveAll(work)
+
+	fmt.Printf("Downloading %s packages for %s...\n", host.pretty, opts.Arch)
+	script, files := packageScript(host, versions, opts.Arch, fetch)
+	if fetch.err != nil {
+		return "", fetch.err
+	}
+	repos := filepath.Join(work, bundleRepoDir)
+	if err := os.MkdirAll(repos, 0755); err != nil {
+		return "", fmt.Errorf("failed to create repository directory: %v", err)
+	}
+	for _, file := range files {
+		if err := os.WriteFile(filepath.Join(repos, filepath.Base(file.path)), []byte(file.content), 0644); err != nil {
+			return "", fmt.Errorf("failed to write %s: %v", file.path, err)
+		}
+	}
+	if _, err := runLocal(ctx, "docker", "run", "--rm", "--platform", platform, "-v", work+":/bundle", opts.Distro, "sh", "-c", script); err != nil {
+		return "", fmt.Errorf("failed to download packages: %v", err)
+	}
+	if err := os.RemoveAll(repos); err != nil {
+		return "", fmt.Errorf("failed to remove repository directory: %v", err)
+	}
+
+	for _, download := range bundleDownloads(host, versions, opts.Arch) {
+		fmt.Printf("Downloading %s...\n", download[1])
+		path := filepath.Join(work, download[0])
+		if err := downloadFile(ctx, download[1], path); err != nil {
+			return "", err
+		}
+		if err := fetch.verifyFile(download[1], path); err != nil {
+			return "", err
+		}
+	}
+
+	fmt.Println("Packing yarn and pm2...")
+	npmScript := fmt.Sprintf("npm install -g --prefix /bundle/npm yarn pm2 && chown -R %d:%d /bundle/npm", os.Getuid(), os.Getgid())
+	if _, err := runLocal(ctx, "docker", "run", "--rm", "--platform", platform, "-v", work+":/bundle", "node:"+versions.Node, "sh", "-c", npmScript); err != nil {
+		return "", fmt.Errorf("failed to pack npm tools: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(work, "images"), 0755); err != nil {
+		return "", fmt.Errorf("failed to create images directory: %v", err)
+	}
+	for _, image := range images {
+		fmt.Printf("Saving %s...\n", image)
+		if _, err := runLocal(ctx, "docker", "pull", "--platform", platform, image); err != nil {
+			return "", err
+		}
+		if _, err := runLocal(ctx, "docker", "save", "-o", filepath.Join(work, "images", imageFileName(image)), image); err != nil {
+			return "", err
+		}
+	}
+
+	builtAt := time.Now().UTC()
+	manifest := bundleManifest{
+		ID:        fmt.Sprintf("%s-%s-%s", host.release(), opts.Arch, builtAt.Format("20060102T150405Z")),
+		OS:        host.name,
+		Distro:    opts.Distro,
+		DistroID:  host.id,
+		VersionID: host.version,
+		Arch:      opts.Arch,
+		Versions:  versions,
+		Images:    images,
+		BuiltAt:   builtAt,
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(work, bundleManifestName), data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write bundle manifest: %v", err)
+	}
+
+	output, err := filepath.Abs(expandBundlePath(opts.Output, host.release(), opts.Arch))
+	if err != nil {
+		return "", err
+	}
+	if _, err := runLocal(ctx, "tar", "-czf", output, "-C", work, "."); err != nil {
+		return "", fmt.Errorf("failed to write %s: %v", output, err)
+	}
+
+	return output, nil
+}
+
+// bundleRepoDir holds the repository files packageScript installs while the
+// bundle is built; it is not packed.
+const bundleRepoDir = "repos"
+
+// packageScript runs inside a container of the target distribution: it adds
+// the same repositories the online install uses and downloads each
+// component's packages with their dependencies. The repository files it
+// returns must be placed in bundleRepoDir first.
+func packageScript(host osFamily, versions types.Versions, arch string, fetch *fetcher) (string, []repoFile) {
+	var commands []string
+	if host.debian() {
+		commands = append(commands, host.refresh(), host.install("curl", "gpg", "lsb-release", "ca-certificates"))
+	} else {
+		commands = append(commands, host.install("dnf-plugins-core"))
+	}
+
+	var files []repoFile
+	files = append(files, host.hashicorpRepoFiles(arch)...)
+	files = append(files, host.dockerRepoFiles(arch)...)
+	files = append(files, host.nodeSourceRepoFiles(versions.NodeJS)...)
+	for _, file := range files {
+		commands = append(commands, fmt.Sprintf("install -m 0644 /bundle/%s/%s %s", bundleRepoDir, filepath.Base(file.path), file.path))
+	}
+
+	commands = append(commands, host.hashicorpRepo(fetch)...)
+	commands = append(commands, host.dockerRepo(fetch)...)
+	commands = append(commands, host.nodeSourceSetup(versions.NodeJS, fetch)...)
+	commands = append(commands, host.infisicalSetup(fetch)...)
+	commands = append(commands, host.refresh())
+
+	for _, p := range packagesFor(host, versions) {
+		dir := "/bundle/packages/" + p.component
+		commands = append(commands, "mkdir -p "+dir, host.download(dir, p.packages...))
+	}
+
+	commands = append(commands, fmt.Sprintf("chown -R %d:%d /bundle", os.Getuid(), os.Getgid()))
+
+	// Containers run as root without sudo.
+	return strings.NewReplacer("sudo -E ", "", "sudo ", "").Replace(strings.Join(commands, " && ")), files
+}
+
+// download fetches packages and their dependencies into dir without installing them.
+func (f osFamily) download(dir string, packages ...string) string {
+	if f.debian() {
+		return fmt.Sprintf("apt-get install -y --reinstall --download-only -o Dir::Cache::archives=%s %s && rm -rf %s/partial %s/lock", dir, strings.Join(packages, " "), dir, dir)
+	}
+	return fmt.Sprintf("%s download --resolve --destdir %s %s", f.pkg, dir, strings.Join(packages, " "))
+}
+
+func imageFileName(image string) string {
+	return strings.NewReplacer("/", "_", ":", "_").Replace(image) + ".tar"
+}
+
+func runLocal(ctx context.Context, name string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v", name, strings.Join(args, " "), err)
+	}
+	return string(output), nil
+}
+
+func downloadFile(ctx context.Context, url, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		return fmt.Errorf("failed to download %s: %v", url, err)
+	}
+	return file.Close()
+}
+
+// hostBundle reads the manifest of the configured bundle for this host and
+// checks that it was built for the host's distribution release and
+// architecture. A host that was not inspected, as when planning, is only
+// checked against the OS family.
+func (im *InstallationManager) hostBundle(host osFamily, arch string) (*bundleManifest, error) {
+	path := expandBundlePath(im.config.Bundle, host.release(), arch)
+
+	manifest, err := readBundleManifest(path)
+	if err != nil {
+		return nil, err
+	}
+
+	built := osFamily{name: manifest.OS, id: manifest.DistroID, version: manifest.VersionID}
+	mismatch := manifest.OS != host.name || manifest.Arch != arch
+	if host.id != "" && (manifest.DistroID != host.id || manifest.VersionID != host.version) {
+		mismatch = true
+	}
+	if mismatch {
+		return nil, fmt.Errorf("bundle %s is built for %s/%s but %s runs %s/%s", path, built.release(), manifest.Arch, im.server.Host, host.release(), arch)
+	}
+
+	return manifest, nil
+}
+
+func readBundleManifest(path string) (*bundleManifest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bundle: %v", err)
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle %s: %v", path, err)
+	}
+
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("bundle %s has no %s", path, bundleManifestName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bundle %s: %v", path, err)
+		}
+
+		if filepath.Clean(header.Name) != bundleManifestName {
+			continue
+		}
+
+		var manifest bundleManifest
+		if err := json.NewDecoder(archive).Decode(&manifest); err != nil {
+			return nil, fmt.Errorf("failed to parse manifest of bundle %s: %v", path, err)
+		}
+		manifest.path = path
+		return &manifest, nil
+	}
+}
+
+// uploadBundle copies the bundle to the host and unpacks it under bundleDir,
+// unless the same bundle is already there.
+func (im *InstallationManager) uploadBundle(manifest *bundleManifest) error {
+	if output, err := im.sshClient.ExecuteCommandWithOutput("cat " + bundleDir + "/" + bundleManifestName); err == nil {
+		var remote bundleManifest
+		if json.Unmarshal([]byte(output), &remote) == nil && remote.ID == manifest.ID {
+			fmt.Printf("Bundle %s already unpacked, skipping upload\n", manifest.ID)
+			return nil
+		}
+	}
+
+	fmt.Printf("Uploading bundle %s...\n", manifest.path)
+	if err := im.sshClient.Upload(manifest.path, bundleUpload, ssh.FileOptions{Mode: 0600}); err != nil {
+		return fmt.Errorf("failed to upload bundle: %v", err)
+	}
+
+	return im.runAll(unpackBundleCommands())
+}
+
+func unpackBundleCommands() []string {
+	return []string{
+		"sudo rm -rf " + bundleDir,
+		"sudo mkdir -p " + bundleDir,
+		fmt.Sprintf("sudo tar --no-same-owner -C %s -xzf %s", bundleDir, bundleUpload),
+		"rm -f " + bundleUpload,
+	}
+}
+
+// bundleComponents are the base components installed from an unpacked bundle.
+// Names, probes and switches match baseComponents.
+func (im *InstallationManager) bundleComponents(host osFamily, manifest *bundleManifest) []component {
+	selected := im.selectedComponents()
+	versions := im.versions()
+	nodeDir := fmt.Sprintf("$HOME/.nvm/versions/node/v%s", versions.Node)
+	nodeBin := nodeDir + "/bin"
+	systemPackages := append(append([]string{}, host.tools...), host.firewall)
+
+	packages := func(component string) string {
+		return host.installFiles(bundleDir + "/packages/" + component)
+	}
+
+	docker := []string{
+		packages("docker"),
+		"sudo systemctl enable --now docker",
+		"sudo usermod -aG docker $USER",
+	}
+	if host.name == amazonFamily.name {
+		docker = append(docker, "sudo install -D -m 0755 "+bundleDir+"/bin/docker-compose /usr/local/lib/docker/cli-plugins/docker-compose")
+	}
+
+	return []component{
+		{
+			name:     "system",
+			commands: []string{packages("system")},
+			probe:    host.installed(systemPackages...) + " && echo installed",
+		},
+		{
+			name:     "tailscale",
+			disabled: !enabled(selected.Tailscale),
+			commands: tailscaleCommands(bundleDir+"/archives/tailscale.tgz", manifest.Versions.Tailscale, manifest.Arch),
+			probe:    "tailscale version",
+		},
+		{
+			name:     "tailnet",
+			disabled: !enabled(selected.Tailscale),
+			commands: []string{fmt.Sprintf("sudo tailscale up --auth-key=%s", im.tailScaleToken)},
+			probe:    "tailscale status > /dev/null && echo connected",
+		},
+		{
+			name:     "docker",
+			commands: docker,
+			probe:    "docker --version && docker compose version",
+			version:  versions.Docker,
+		},
+		{
+			name:     "docker-images",
+			commands: []string{fmt.Sprintf("for image in %s/images/*.tar; do sudo docker load -i \"$image\"; done", bundleDir)},
+			probe:    fmt.Sprintf("sudo docker image inspect %s > /dev/null && echo loaded", strings.Join(manifest.Images, " ")),
+		},
+		{
+			name:     "nodejs",
+			disabled: !enabled(selected.Node),
+			commands: []string{packages("nodejs")},
+			probe:    "node --version",
+			version:  versions.NodeJS,
+		},
+		{
+			name:     "redis",
+			disabled: !enabled(selected.Redis),
+			commands: []string{
+				packages("redis"),
+				"sudo systemctl enable " + host.redisService,
+				"sudo systemctl start " + host.redisService,
+			},
+			probe: host.redisServer + " --version && systemctl is-active " + host.redisService,
+		},
+		{
+			name:     "nvm",
+			disabled: !enabled(selected.Node),
+			commands: []string{
+				"mkdir -p " + nodeDir,
+				fmt.Sprintf("tar -C %s --strip-components=1 -xzf %s/archives/node.tar.gz", nodeDir, bundleDir),
+			},
+			probe:   nodeBin + "/node --version",
+			version: versions.Node,
+		},
+		{
+			name:     "npm-tools",
+			disabled: !enabled(selected.Node),
+			commands: []string{fmt.Sprintf("cp -r %s/npm/. %s/", bundleDir, nodeDir)},
+			probe:    nodeBin + "/yarn --version && " + nodeBin + "/pm2 --version",
+		},
+		{
+			name:     "infisical",
+			disabled: !enabled(selected.Infisical),
+			commands: []string{packages("infisical")},
+			probe:    "infisical --version",
+		},
+		{
+			name:     "nixpacks",
+			disabled: !enabled(selected.Nixpacks),
+			commands: []string{fmt.Sprintf("sudo tar -C /usr/local/bin -xzf %s/archives/nixpacks.tar.gz nixpacks", bundleDir)},
+			probe:    "nixpacks --version",
+		},
+		{
+			name:     "nomad",
+			commands: []string{packages("nomad")},
+			probe:    "nomad version && " + host.installed("consul-cni"),
+			version:  versions.Nomad,
+		},
+		{
+			name:     "runner",
+			commands: []string{"sudo install -m 0755 " + bundleDir + "/bin/runner /usr/local/bin/runner"},
+			probe:    "test -x /usr/local/bin/runner && echo installed",
+		},
+		{
+			name: "cni-plugins",
+			commands: []string{
+				"sudo mkdir -p /opt/cni/bin",
+				fmt.Sprintf("sudo tar -C /opt/cni/bin -xzf %s/archives/cni-plugins.tgz", bundleDir),
+			},
+			probe:   "/opt/cni/bin/bridge --version",
+			version: versions.CNI,
+		},
+	}
+}
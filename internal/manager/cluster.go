@@ -1,6 +1,7 @@
 package manager
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"strconv"
@@ -13,6 +14,7 @@ type ClusterManager struct {
 	TotalNodes  int
 	ServerNodes int
 	ServerHosts []string
+	Servers     []types.Server
 	RoleMapping map[string][]types.ClusterRole
 }
 
@@ -22,41 +24,166 @@ type StandardRequirement struct {
 	Storage float64
 }
 
-func NewClusterRoles(machines []types.Server) *ClusterManager {
-	totalNodes := len(machines)
-	var serverNodes int
+// PlanTopology assigns Nomad roles to machines. When any machine lists its
+// roles explicitly in the config, every machine's roles are taken from the
+// config and machines without roles run only a client. Otherwise the first 1, 3
+// or 5 machines also run a Nomad server, so the quorum is always odd. A plan
+// with an even number of servers is refused unless force is set.
+func PlanTopology(machines []types.Server, force bool) (*types.Topology, error) {
+	explicit := false
+	for _, machine := range machines {
+		if len(machine.Roles) > 0 {
+			explicit = true
+			break
+		}
+	}
 
-	switch totalNodes {
-	case 1, 2:
-		serverNodes = 1
-	default:
-		serverNodes = totalNodes - 1
+	serverNodes := plannedServerCount(len(machines))
+	topology := &types.Topology{}
+
+	for i, machine := range machines {
+		var roles []types.ClusterRole
+
+		if explicit {
+			var err error
+			if roles, err = configuredRoles(machine); err != nil {
+				return nil, err
+			}
+		} else {
+			roles = []types.ClusterRole{types.RoleClient}
+			if i < serverNodes {
+				roles = append(roles, types.RoleServer)
+			}
+		}
+
+		topology.Members = append(topology.Members, types.ClusterMember{Server: machine, Roles: roles})
+	}
+
+	if err := checkQuorum(topology, force); err != nil {
+		return nil, err
 	}
 
-	serverHosts := make([]string, serverNodes)
-	for i := 0; i < serverNodes; i++ {
-		serverHosts[i] = machines[i].Host
+	return topology, nil
+}
+
+// ExtendTopology adds the machines that are not yet members of topology, matched
+// by private IP, without changing the roles of existing members. New machines
+// run only a client unless the config lists their roles. It reports whether
+// anything was added.
+func ExtendTopology(topology *types.Topology, machines []types.Server, force bool) (bool, error) {
+	changed := false
+
+	for _, machine := range machines {
+		if i := memberIndex(topology, machine.PrivateIP); i >= 0 {
+			// Refresh the connection details, the roles stay as recorded.
+			topology.Members[i].Server = machine
+			continue
+		}
+
+		roles, err := configuredRoles(machine)
+		if err != nil {
+			return false, err
+		}
+
+		topology.Members = append(topology.Members, types.ClusterMember{Server: machine, Roles: roles})
+		changed = true
 	}
 
-	// log.Printf("Debug NewClusterRoles: Total nodes: %d, Server nodes: %d", totalNodes, serverNodes)
-	// log.Printf("Debug NewClusterRoles: Server hosts: %v", serverHosts)
+	if changed {
+		if err := checkQuorum(topology, force); err != nil {
+			return false, err
+		}
+	}
 
-	return &ClusterManager{
-		TotalNodes:  totalNodes,
-		ServerNodes: serverNodes,
-		ServerHosts: serverHosts,
+	return changed, nil
+}
+
+// RemoveMember drops the member with the given private IP and reports whether it was present.
+func RemoveMember(topology *types.Topology, privateIP string) bool {
+	i := memberIndex(topology, privateIP)
+	if i < 0 {
+		return false
+	}
+
+	topology.Members = append(topology.Members[:i], topology.Members[i+1:]...)
+	return true
+}
+
+// NewClusterManager indexes a topology for role and server lookups.
+func NewClusterManager(topology *types.Topology) *ClusterManager {
+	cm := &ClusterManager{
+		TotalNodes:  len(topology.Members),
 		RoleMapping: make(map[string][]types.ClusterRole),
 	}
+
+	for _, member := range topology.Members {
+		cm.RoleMapping[member.Server.Host] = member.Roles
+
+		if HasRole(member.Roles, types.RoleServer) {
+			cm.ServerHosts = append(cm.ServerHosts, member.Server.Host)
+			cm.Servers = append(cm.Servers, member.Server)
+		}
+	}
+
+	cm.ServerNodes = len(cm.ServerHosts)
+
+	return cm
 }
 
-func (cm *ClusterManager) CalculateRoles(machines []types.Server) {
-	for i, machine := range machines {
-		roles := []types.ClusterRole{types.RoleClient}
-		if i < cm.ServerNodes {
-			roles = append(roles, types.RoleServer)
+func configuredRoles(machine types.Server) ([]types.ClusterRole, error) {
+	var roles []types.ClusterRole
+	for _, role := range machine.Roles {
+		if role != types.RoleServer && role != types.RoleClient {
+			return nil, fmt.Errorf("unknown role %q for %s, expected %q or %q", role, machine.Host, types.RoleServer, types.RoleClient)
 		}
-		cm.RoleMapping[machine.Host] = roles
-		//log.Printf("Debug CalculateRoles: Server %s (index %d) assigned roles: %v", machine.Host, i, roles)
+		roles = append(roles, role)
+	}
+
+	if len(roles) == 0 {
+		roles = []types.ClusterRole{types.RoleClient}
+	}
+
+	return roles, nil
+}
+
+func checkQuorum(topology *types.Topology, force bool) error {
+	servers := 0
+	for _, member := range topology.Members {
+		if HasRole(member.Roles, types.RoleServer) {
+			servers++
+		}
+	}
+
+	if servers == 0 && len(topology.Members) > 0 {
+		return fmt.Errorf("no machine is assigned the %q role", types.RoleServer)
+	}
+
+	if servers%2 == 0 && servers > 0 && !force {
+		return fmt.Errorf("%d Nomad servers form an even quorum, which tolerates no more failures than %d servers would; use an odd number of servers or force the topology", servers, servers-1)
+	}
+
+	return nil
+}
+
+func memberIndex(topology *types.Topology, privateIP string) int {
+	for i, member := range topology.Members {
+		if member.Server.PrivateIP == privateIP {
+			return i
+		}
+	}
+	return -1
+}
+
+// plannedServerCount picks how many machines run a Nomad server: 1 below three
+// machines, 3 below five and 5 from then on.
+func plannedServerCount(totalNodes int) int {
+	switch {
+	case totalNodes < 3:
+		return 1
+	case totalNodes < 5:
+		return 3
+	default:
+		return 5
 	}
 }
 
@@ -64,7 +191,65 @@ func (cm *ClusterManager) GetServerRoles(serverHost string) []types.ClusterRole
 	return cm.RoleMapping[serverHost]
 }
 
-func (im *InstallationManager) VerifyMachineRequirement() error {
+func HasRole(roles []types.ClusterRole, role types.ClusterRole) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// RolesFromName reverses RoleName.
+func RolesFromName(name string) []types.ClusterRole {
+	switch name {
+	case "both":
+		return []types.ClusterRole{types.RoleClient, types.RoleServer}
+	case "server":
+		return []types.ClusterRole{types.RoleServer}
+	default:
+		return []types.ClusterRole{types.RoleClient}
+	}
+}
+
+// RoleName is how a set of roles is recorded in the servers table.
+func RoleName(roles []types.ClusterRole) string {
+	isServer := HasRole(roles, types.RoleServer)
+	isClient := HasRole(roles, types.RoleClient)
+
+	switch {
+	case isServer && isClient:
+		return "both"
+	case isServer:
+		return "server"
+	default:
+		return "client"
+	}
+}
+
+const (
+	cpuCommand     = "nproc"
+	storageCommand = "df -k / | awk 'NR==2{print $4}'"
+	memoryCommand  = "free -k | awk '/^Mem:/ {print $2}'"
+)
+
+var requirementCommands = []string{cpuCommand, storageCommand, memoryCommand}
+
+func (im *InstallationManager) VerifyMachineRequirement(ctx context.Context) error {
+	if _, err := im.networkMode(); err != nil {
+		return err
+	}
+
+	host, err := im.hostOS()
+	if err != nil {
+		return err
+	}
+	arch, err := im.Architecture()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Detected %s (%s) on %s\n", host.pretty, arch, im.server.Host)
+
 	var storageGB float64
 	var cores int
 	var memoryGB int
@@ -81,25 +266,19 @@ func (im *InstallationManager) VerifyMachineRequirement() error {
 		Storage: 10,
 	}
 
-	commands := []string{
-		"nproc",
-		"df -k / | awk 'NR==2{print $4}'",
-		"free -k | awk '/^Mem:/ {print $2}'",
-	}
-
-	for _, command := range commands {
-		result, err := im.sshClient.ExecuteCommandWithOutput(command)
+	for _, command := range requirementCommands {
+		result, err := im.sshClient.ExecuteCommandWithOutputContext(ctx, command)
 		if err != nil {
 			return fmt.Errorf("failed to execute command %s: %v", command, err)
 		}
 
 		switch command {
-		case "nproc":
+		case cpuCommand:
 			cores, _ = strconv.Atoi(strings.TrimSpace(result))
-		case "df -k / | awk 'NR==2{print $4}'":
+		case storageCommand:
 			storage, _ := strconv.Atoi(strings.TrimSpace(result))
 			storageGB = float64(storage) / 1024 / 1024
-		case "free -k | awk '/^Mem:/ {print $2}'":
+		case memoryCommand:
 			memory, _ := strconv.Atoi(strings.TrimSpace(result))
 			memoryGB = int(math.Round(float64(memory) / 1024 / 1024))
 		}
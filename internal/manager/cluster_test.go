@@ -0,0 +1,209 @@
+package manager
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/brimblehq/migration/internal/types"
+)
+
+// testMachines returns n machines; roles, when given, are their configured roles.
+func testMachines(n int, roles ...[]types.ClusterRole) []types.Server {
+	var machines []types.Server
+	for i := 0; i < n; i++ {
+		machine := types.Server{Host: fmt.Sprintf("node-%d", i), PrivateIP: fmt.Sprintf("10.0.0.%d", i+1)}
+		if i < len(roles) {
+			machine.Roles = roles[i]
+		}
+		machines = append(machines, machine)
+	}
+	return machines
+}
+
+// roleNames lists each member's roles as recorded in the servers table.
+func roleNames(topology *types.Topology) []string {
+	var names []string
+	for _, member := range topology.Members {
+		names = append(names, RoleName(member.Roles))
+	}
+	return names
+}
+
+var (
+	serverOnly   = []types.ClusterRole{types.RoleServer}
+	clientOnly   = []types.ClusterRole{types.RoleClient}
+	serverClient = []types.ClusterRole{types.RoleServer, types.RoleClient}
+)
+
+func TestPlanTopology(t *testing.T) {
+	tests := []struct {
+		name     string
+		machines []types.Server
+		force    bool
+		roles    []string
+		wantErr  string
+	}{
+		{name: "1 machine", machines: testMachines(1), roles: []string{"both"}},
+		{name: "2 machines", machines: testMachines(2), roles: []string{"both", "client"}},
+		{name: "3 machines", machines: testMachines(3), roles: []string{"both", "both", "both"}},
+		{name: "4 machines", machines: testMachines(4), roles: []string{"both", "both", "both", "client"}},
+		{name: "5 machines", machines: testMachines(5), roles: []string{"both", "both", "both", "both", "both"}},
+		{name: "6 machines", machines: testMachines(6), roles: []string{"both", "both", "both", "both", "both", "client"}},
+		{
+			name:     "explicit roles",
+			machines: testMachines(4, serverOnly, serverClient, serverOnly),
+			roles:    []string{"server", "both", "server", "client"},
+		},
+		{
+			name:     "explicit roles without a server",
+			machines: testMachines(2, clientOnly),
+			wantErr:  `no machine is assigned the "server" role`,
+		},
+		{
+			name:     "unknown role",
+			machines: testMachines(2, []types.ClusterRole{"worker"}),
+			wantErr:  `unknown role "worker" for node-0`,
+		},
+		{
+			name:     "even servers",
+			machines: testMachines(3, serverOnly, serverOnly),
+			wantErr:  "2 Nomad servers form an even quorum",
+		},
+		{
+			name:     "even servers with force",
+			machines: testMachines(3, serverOnly, serverOnly),
+			force:    true,
+			roles:    []string{"server", "server", "client"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topology, err := PlanTopology(tt.machines, tt.force)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if roles := roleNames(topology); !reflect.DeepEqual(roles, tt.roles) {
+				t.Errorf("roles = %q, want %q", roles, tt.roles)
+			}
+		})
+	}
+}
+
+func TestCheckQuorum(t *testing.T) {
+	tests := []struct {
+		name    string
+		roles   [][]types.ClusterRole
+		force   bool
+		wantErr bool
+	}{
+		{name: "empty topology", roles: nil},
+		{name: "no servers", roles: [][]types.ClusterRole{clientOnly, clientOnly}, wantErr: true},
+		{name: "no servers with force", roles: [][]types.ClusterRole{clientOnly}, force: true, wantErr: true},
+		{name: "one server", roles: [][]types.ClusterRole{serverClient, clientOnly}},
+		{name: "two servers", roles: [][]types.ClusterRole{serverOnly, serverClient}, wantErr: true},
+		{name: "two servers with force", roles: [][]types.ClusterRole{serverOnly, serverClient}, force: true},
+		{name: "three servers", roles: [][]types.ClusterRole{serverOnly, serverOnly, serverClient, clientOnly}},
+		{name: "four servers", roles: [][]types.ClusterRole{serverClient, serverClient, serverClient, serverClient}, wantErr: true},
+		{name: "four servers with force", roles: [][]types.ClusterRole{serverClient, serverClient, serverClient, serverClient}, force: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topology := &types.Topology{}
+			for i, machine := range testMachines(len(tt.roles)) {
+				topology.Members = append(topology.Members, types.ClusterMember{Server: machine, Roles: tt.roles[i]})
+			}
+
+			err := checkQuorum(topology, tt.force)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkQuorum() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExtendTopology(t *testing.T) {
+	tests := []struct {
+		name     string
+		machines []types.Server
+		force    bool
+		changed  bool
+		roles    []string
+		wantErr  string
+	}{
+		{
+			name:     "nothing new",
+			machines: testMachines(3),
+			roles:    []string{"both", "both", "both"},
+		},
+		{
+			name:     "new machines join as clients",
+			machines: testMachines(5),
+			changed:  true,
+			roles:    []string{"both", "both", "both", "client", "client"},
+		},
+		{
+			name: "recorded roles win over the config",
+			// The config now lists node-0 as a client only.
+			machines: testMachines(4, clientOnly),
+			changed:  true,
+			roles:    []string{"both", "both", "both", "client"},
+		},
+		{
+			name:     "new machines with configured roles",
+			machines: testMachines(5, nil, nil, nil, serverOnly, serverOnly),
+			changed:  true,
+			roles:    []string{"both", "both", "both", "server", "server"},
+		},
+		{
+			name:     "even result refused",
+			machines: testMachines(4, nil, nil, nil, serverOnly),
+			wantErr:  "4 Nomad servers form an even quorum",
+		},
+		{
+			name:     "even result with force",
+			machines: testMachines(4, nil, nil, nil, serverOnly),
+			force:    true,
+			changed:  true,
+			roles:    []string{"both", "both", "both", "server"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The persisted topology planned for three machines.
+			topology, err := PlanTopology(testMachines(3), false)
+			if err != nil {
+				t.Fatalf("PlanTopology: %v", err)
+			}
+
+			changed, err := ExtendTopology(topology, tt.machines, tt.force)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if changed != tt.changed {
+				t.Errorf("changed = %v, want %v", changed, tt.changed)
+			}
+			if roles := roleNames(topology); !reflect.DeepEqual(roles, tt.roles) {
+				t.Errorf("roles = %q, want %q", roles, tt.roles)
+			}
+		})
+	}
+}
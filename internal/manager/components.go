@@ -0,0 +1,305 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/brimblehq/migration/internal/ssh"
+	"github.com/brimblehq/migration/internal/types"
+)
+
+// component is one unit of the base packages. Each is installed, probed and
+// recorded on its own, so a rerun after a failure resumes at the component that
+// failed instead of starting over.
+type component struct {
+	name string
+	// files are written before commands run.
+	files    []repoFile
+	commands []string
+	// probe exits zero once the component is present; its first output line is
+	// recorded as the installed version.
+	probe string
+	// version is what the probe output must report; empty accepts any version.
+	version string
+	// disabled components are switched off in the config and left alone.
+	disabled bool
+}
+
+// baseComponents installs from the internet. Downloads go through fetch; check
+// fetch.err once the list is built.
+func (im *InstallationManager) baseComponents(host osFamily, arch string, fetch *fetcher) []component {
+	selected := im.selectedComponents()
+	versions := im.versions()
+	nodeBin := fmt.Sprintf("$HOME/.nvm/versions/node/v%s/bin", versions.Node)
+
+	nomadInstall := host.install("nomad")
+	if pinned(versions.Nomad) {
+		nomadInstall = host.install(host.pin("nomad", versions.Nomad))
+		if host.debian() {
+			nomadInstall = host.install("--allow-downgrades", host.pin("nomad", versions.Nomad))
+		}
+	}
+
+	systemPackages := append(append([]string{}, host.tools...), host.firewall)
+
+	return []component{
+		{
+			name: "system",
+			commands: []string{
+				host.refresh(),
+				host.upgrade(),
+				host.install(systemPackages...),
+			},
+			probe: host.installed(systemPackages...) + " && echo installed",
+		},
+		{
+			name:     "tailscale",
+			disabled: !enabled(selected.Tailscale),
+			commands: append(fetch.fetch(tailscaleURL(versions.Tailscale, arch), "/tmp/tailscale.tgz"),
+				append(tailscaleCommands("/tmp/tailscale.tgz", versions.Tailscale, arch), "rm -f /tmp/tailscale.tgz")...,
+			),
+			probe: "tailscale version",
+		},
+		{
+			name:     "tailnet",
+			disabled: !enabled(selected.Tailscale),
+			commands: []string{fmt.Sprintf("sudo tailscale up --auth-key=%s", im.tailScaleToken)},
+			probe:    "tailscale status > /dev/null && echo connected",
+		},
+		{
+			name:     "docker",
+			files:    host.dockerRepoFiles(arch),
+			commands: host.dockerCommands(versions, arch, fetch),
+			probe:    "docker --version && docker compose version",
+			version:  versions.Docker,
+		},
+		{
+			name:     "nodejs",
+			disabled: !enabled(selected.Node),
+			files:    host.nodeSourceRepoFiles(versions.NodeJS),
+			commands: append(host.nodeSourceSetup(versions.NodeJS, fetch),
+				host.install("nodejs"),
+			),
+			probe:   "node --version",
+			version: versions.NodeJS,
+		},
+		{
+			name:     "redis",
+			disabled: !enabled(selected.Redis),
+			commands: []string{
+				host.install(host.redisPackage),
+				"sudo systemctl enable " + host.redisService,
+				"sudo systemctl start " + host.redisService,
+			},
+			probe: host.redisServer + " --version && systemctl is-active " + host.redisService,
+		},
+		{
+			name:     "nvm",
+			disabled: !enabled(selected.Node),
+			commands: append(fetch.fetch("https://raw.githubusercontent.com/nvm-sh/nvm/v0.40.1/install.sh", "/tmp/nvm-install.sh"),
+				"bash /tmp/nvm-install.sh",
+				"export NVM_DIR=\"$HOME/.nvm\" && [ -s \"$NVM_DIR/nvm.sh\" ] && . \"$NVM_DIR/nvm.sh\" && [ -s \"$NVM_DIR/bash_completion\" ] && . \"$NVM_DIR/bash_completion\" && nvm install "+versions.Node+" && nvm alias default "+versions.Node,
+			),
+			probe:   nodeBin + "/node --version",
+			version: versions.Node,
+		},
+		{
+			name:     "npm-tools",
+			disabled: !enabled(selected.Node),
+			commands: []string{
+				nodeBin + "/npm install --global yarn",
+				nodeBin + "/npm install -g pm2",
+			},
+			probe: nodeBin + "/yarn --version && " + nodeBin + "/pm2 --version",
+		},
+		{
+			name:     "infisical",
+			disabled: !enabled(selected.Infisical),
+			commands: append(host.infisicalSetup(fetch),
+				host.install("infisical"),
+			),
+			probe: "infisical --version",
+		},
+		{
+			name:     "nixpacks",
+			disabled: !enabled(selected.Nixpacks),
+			commands: append(fetch.fetch(nixpacksURL(versions.Nixpacks, arch), "/tmp/nixpacks.tar.gz"),
+				"sudo tar -C /usr/local/bin -xzf /tmp/nixpacks.tar.gz nixpacks",
+				"rm -f /tmp/nixpacks.tar.gz",
+			),
+			probe: "nixpacks --version",
+		},
+		{
+			name:  "nomad",
+			files: host.hashicorpRepoFiles(arch),
+			commands: append(host.hashicorpRepo(fetch),
+				host.refresh(),
+				nomadInstall,
+				host.install("consul-cni"),
+			),
+			probe:   "nomad version && " + host.installed("consul-cni"),
+			version: versions.Nomad,
+		},
+		{
+			name: "runner",
+			commands: append(fetch.fetch(runnerURL(arch), "runner.sh"),
+				"sudo chmod +x runner.sh",
+				"sudo mv runner.sh /usr/local/bin/runner",
+			),
+			probe: "test -x /usr/local/bin/runner && echo installed",
+		},
+		{
+			name: "cni-plugins",
+			commands: append(fetch.fetch(cniURL(versions.CNI, arch), "cni-plugins.tgz"),
+				"sudo mkdir -p /opt/cni/bin",
+				"sudo tar -C /opt/cni/bin -xzf cni-plugins.tgz",
+			),
+			probe:   "/opt/cni/bin/bridge --version",
+			version: versions.CNI,
+		},
+	}
+}
+
+// InstallBasePackages installs every base component that the host does not
+// already have at the wanted version, recording each one as it completes.
+func (im *InstallationManager) InstallBasePackages(ctx context.Context, machineID string) error {
+	host, err := im.hostOS()
+	if err != nil {
+		return err
+	}
+
+	arch, err := im.Architecture()
+	if err != nil {
+		return err
+	}
+
+	var components []component
+	if im.config.Bundle != "" {
+		// The bundle's files were checked when it was built, so no download
+		// manifest is needed.
+		manifest, err := im.hostBundle(host, arch)
+		if err != nil {
+			return err
+		}
+		if err := im.uploadBundle(manifest); err != nil {
+			return err
+		}
+		components = im.bundleComponents(host, manifest)
+	} else {
+		fetch := im.fetcher()
+		components = im.baseComponents(host, arch, fetch)
+		if fetch.err != nil {
+			return fetch.err
+		}
+		if !fetch.verified() {
+			fmt.Println("Warning: " + unverifiedNote)
+		}
+	}
+
+	for _, c := range components {
+		if c.disabled {
+			fmt.Printf("%s disabled in components, skipping\n", c.name)
+			continue
+		}
+
+		if version, ok := im.probeComponent(ctx, c); ok {
+			fmt.Printf("%s already installed (%s), skipping\n", c.name, version)
+			if err := im.DB.RecordComponent(machineID, c.name, version); err != nil {
+				return err
+			}
+			continue
+		}
+
+		fmt.Printf("Installing %s...\n", c.name)
+		for _, file := range c.files {
+			if err := im.sshClient.WriteFile(file.path, []byte(file.content), ssh.FileOptions{Mode: 0644, Sudo: true}); err != nil {
+				return fmt.Errorf("failed to install %s: writing %s: %v", c.name, file.path, err)
+			}
+		}
+		for _, cmd := range c.commands {
+			if err := im.sshClient.ExecuteCommandContext(ctx, cmd); err != nil {
+				return fmt.Errorf("failed to install %s: command %q: %v", c.name, im.redact(cmd), err)
+			}
+		}
+
+		version, ok := im.probeComponent(ctx, c)
+		if !ok {
+			return fmt.Errorf("%s installed but %q does not report version %s", c.name, c.probe, c.version)
+		}
+
+		if err := im.DB.RecordComponent(machineID, c.name, version); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// selectedComponents applies the server's overrides to the cluster-wide
+// components. Monitoring runs cluster-wide, so only the cluster setting counts.
+func (im *InstallationManager) selectedComponents() types.Components {
+	selected := im.config.ClusterConfig.Components
+
+	override := im.server.Components
+	if override == nil {
+		return selected
+	}
+
+	for _, field := range []struct{ from, to **bool }{
+		{&override.Redis, &selected.Redis},
+		{&override.Node, &selected.Node},
+		{&override.Nixpacks, &selected.Nixpacks},
+		{&override.Infisical, &selected.Infisical},
+		{&override.Tailscale, &selected.Tailscale},
+	} {
+		if *field.from != nil {
+			*field.to = *field.from
+		}
+	}
+
+	return selected
+}
+
+// MonitoringEnabled reports whether the cluster deploys the monitoring jobs at all.
+func (im *InstallationManager) MonitoringEnabled() bool {
+	return enabled(im.config.ClusterConfig.Components.Monitoring)
+}
+
+func enabled(flag *bool) bool {
+	return flag == nil || *flag
+}
+
+// probeComponent reports whether the component is present at the wanted
+// version, and the version it reports.
+func (im *InstallationManager) probeComponent(ctx context.Context, c component) (string, bool) {
+	output, err := im.sshClient.ExecuteCommandWithOutputContext(ctx, c.probe)
+	if err != nil {
+		return "", false
+	}
+
+	version := strings.TrimSpace(strings.SplitN(strings.TrimSpace(output), "\n", 2)[0])
+	if !versionMatches(version, c.version) {
+		log.Printf("%s reports %q, want %s", c.name, version, c.version)
+		return version, false
+	}
+
+	return version, true
+}
+
+var versionPattern = regexp.MustCompile(`\d+(\.\d+)*`)
+
+// versionMatches checks the first version number in output against want,
+// which may be partial ("20" or "20.x" accepts 20.18.1). An empty want or
+// "latest" accepts any version.
+func versionMatches(output, want string) bool {
+	want = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(want), "v"), ".x")
+	if want == "" || want == "latest" {
+		return true
+	}
+
+	found := versionPattern.FindString(output)
+	return found == want || strings.HasPrefix(found, want+".")
+}
@@ -0,0 +1,236 @@
+package manager
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/brimblehq/migration/internal/types"
+)
+
+// fetcher builds the commands that download an artifact on a host and verify
+// it against the download manifest before anything runs or installs it. A
+// lookup that fails is kept in err, so a component list is built in one pass
+// and checked once.
+type fetcher struct {
+	// downloads is nil when no manifest is configured.
+	downloads types.Downloads
+	// insecure fetches artifacts missing from downloads unverified instead of
+	// failing.
+	insecure bool
+	err      error
+	// fetched lists every URL asked for, in order.
+	fetched []string
+}
+
+func loadDownloads(path string) (types.Downloads, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read download manifest: %v", err)
+	}
+
+	var downloads types.Downloads
+	if err := json.Unmarshal(data, &downloads); err != nil {
+		return nil, fmt.Errorf("failed to parse download manifest %s: %v", path, err)
+	}
+
+	return downloads, nil
+}
+
+// fetcher reads the configured download manifest once per manager. Without a
+// manifest every download fails unless insecure_downloads is set.
+func (im *InstallationManager) fetcher() *fetcher {
+	insecure := im.config.InsecureDownloads
+	if im.config.DownloadManifest == "" {
+		if insecure {
+			return &fetcher{insecure: true}
+		}
+		return &fetcher{err: fmt.Errorf("no download_manifest is configured: record one with `brimble checksums`, or pass --insecure-downloads to install without verifying downloads")}
+	}
+
+	if im.downloads == nil {
+		downloads, err := loadDownloads(im.config.DownloadManifest)
+		if err != nil {
+			return &fetcher{err: err}
+		}
+		im.downloads = downloads
+	}
+
+	return &fetcher{downloads: im.downloads, insecure: insecure}
+}
+
+// verified reports whether every download is checked against the manifest.
+func (f *fetcher) verified() bool {
+	return !f.insecure
+}
+
+// missing records that url has no SHA-256 sum in the manifest, which fails
+// unless downloads are insecure.
+func (f *fetcher) missing(url string) error {
+	if f.insecure {
+		return nil
+	}
+	return fmt.Errorf("no SHA-256 sum for %s in the download manifest: add it with `brimble checksums`, or pass --insecure-downloads to install it unverified", url)
+}
+
+// fetch downloads url to dest on the host and verifies its SHA-256 sum and, when
+// the manifest lists one, its signature. Any mismatch fails the command and
+// removes dest.
+func (f *fetcher) fetch(url, dest string) []string {
+	f.fetched = append(f.fetched, url)
+
+	commands := []string{fmt.Sprintf("curl -fsSL %q -o %s", url, dest)}
+
+	download, ok := f.downloads[url]
+	if !ok || download.SHA256 == "" {
+		if err := f.missing(url); err != nil && f.err == nil {
+			f.err = err
+		}
+		return commands
+	}
+
+	commands = append(commands, fmt.Sprintf(`echo "%s  %s" | sha256sum -c --quiet - || { echo "checksum mismatch for %s" >&2; rm -f %s; exit 1; }`, strings.ToLower(download.SHA256), dest, url, dest))
+
+	switch {
+	case download.Signature == "":
+	case download.GPGKey != "":
+		keyring := dest + ".keyring.gpg"
+		commands = append(commands,
+			fmt.Sprintf("curl -fsSL %q -o %s.sig", download.Signature, dest),
+			fmt.Sprintf("curl -fsSL %q | gpg --batch --no-default-keyring --keyring %s --import", download.GPGKey, keyring),
+			fmt.Sprintf(`gpg --batch --no-default-keyring --keyring %s --verify %s.sig %s || { echo "bad signature for %s" >&2; rm -f %s; exit 1; }`, keyring, dest, dest, url, dest),
+			fmt.Sprintf("rm -f %s.sig %s", dest, keyring),
+		)
+	case download.MinisignKey != "":
+		commands = append(commands,
+			fmt.Sprintf("curl -fsSL %q -o %s.minisig", download.Signature, dest),
+			fmt.Sprintf(`minisign -Vm %s -x %s.minisig -P %s || { echo "bad signature for %s" >&2; rm -f %s; exit 1; }`, dest, dest, download.MinisignKey, url, dest),
+			fmt.Sprintf("rm -f %s.minisig", dest),
+		)
+	default:
+		if f.err == nil {
+			f.err = fmt.Errorf("signature for %s in the download manifest has no gpg_key or minisign_key", url)
+		}
+	}
+
+	return commands
+}
+
+// verifyFile checks a file downloaded locally, for the bundle, against the
+// manifest's SHA-256 sum. Signatures are checked on the hosts that install it.
+func (f *fetcher) verifyFile(url, path string) error {
+	f.fetched = append(f.fetched, url)
+
+	download, ok := f.downloads[url]
+	if !ok || download.SHA256 == "" {
+		return f.missing(url)
+	}
+
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(sum, download.SHA256) {
+		os.Remove(path)
+		return fmt.Errorf("checksum mismatch for %s: got %s, want %s", url, sum, download.SHA256)
+	}
+
+	return nil
+}
+
+func fileSHA256(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// unverifiedNote is printed when insecure downloads are allowed.
+const unverifiedNote = "insecure downloads are allowed: artifacts missing from the download manifest are not verified"
+
+// DownloadURLs lists every URL the installer downloads for the configured
+// versions, across the supported OS families and architectures.
+func (im *InstallationManager) DownloadURLs() []string {
+	f := &fetcher{insecure: true}
+	versions := im.versions()
+
+	debian := debianFamily
+	debian.distro = "debian"
+
+	for _, host := range []osFamily{debianFamily, debian, rhelFamily, amazonFamily} {
+		for _, arch := range []string{"amd64", "arm64"} {
+			im.baseComponents(host, arch, f)
+			packageScript(host, versions, arch, f)
+			for _, download := range bundleDownloads(host, versions, arch) {
+				f.fetched = append(f.fetched, download[1])
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	var urls []string
+	for _, url := range f.fetched {
+		if !seen[url] {
+			seen[url] = true
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// UpdateDownloadManifest adds the SHA-256 sum of every download missing from
+// the manifest at path, fetching each from where this runs. Existing entries,
+// and the signatures in them, are kept.
+func (im *InstallationManager) UpdateDownloadManifest(ctx context.Context, path string) (int, error) {
+	downloads := types.Downloads{}
+	if _, err := os.Stat(path); err == nil {
+		if downloads, err = loadDownloads(path); err != nil {
+			return 0, err
+		}
+	}
+
+	work, err := os.MkdirTemp("", "brimble-downloads-")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create work directory: %v", err)
+	}
+	defer os.RemoveAll(work)
+
+	added := 0
+	for _, url := range im.DownloadURLs() {
+		if _, ok := downloads[url]; ok {
+			continue
+		}
+
+		fmt.Printf("Hashing %s...\n", url)
+		file := filepath.Join(work, "download")
+		if err := downloadFile(ctx, url, file); err != nil {
+			return added, err
+		}
+
+		sum, err := fileSHA256(file)
+		if err != nil {
+			return added, err
+		}
+
+		downloads[url] = types.Download{SHA256: sum}
+		added++
+	}
+
+	data, err := json.MarshalIndent(downloads, "", "  ")
+	if err != nil {
+		return added, err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return added, fmt.Errorf("failed to write download manifest: %v", err)
+	}
+
+	return added, nil
+}
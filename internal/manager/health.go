@@ -0,0 +1,51 @@
+package manager
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/brimblehq/migration/internal/ssh"
+)
+
+type HealthReport struct {
+	NomadAgent   string `json:"nomad_agent"`
+	NomadServers int    `json:"nomad_servers"`
+	ConsulLeader string `json:"consul_leader"`
+	Runner       string `json:"runner"`
+}
+
+// ProbeHealth queries the local Nomad and Consul agents and the runner process on a host.
+// Server members are only counted when the host runs a Nomad server; nomadToken
+// is the management token when the cluster runs with ACLs.
+func ProbeHealth(client *ssh.SSHClient, isServer bool, nomadToken string) HealthReport {
+	report := HealthReport{
+		NomadAgent:   "down",
+		ConsulLeader: "none",
+		Runner:       "stopped",
+	}
+
+	health, err := client.ExecuteCommandWithOutput("curl -s http://127.0.0.1:4646/v1/agent/health")
+	if err == nil && strings.Contains(health, "ok") {
+		report.NomadAgent = "healthy"
+	} else if err == nil && strings.TrimSpace(health) != "" {
+		report.NomadAgent = "unhealthy"
+	}
+
+	if isServer && writeNomadToken(client, nomadToken) == nil {
+		members, err := client.ExecuteCommandWithOutput(withNomadToken(nomadToken, "nomad server members 2>/dev/null | grep -c alive || true"))
+		if err == nil {
+			report.NomadServers, _ = strconv.Atoi(strings.TrimSpace(members))
+		}
+	}
+
+	leader, err := client.ExecuteCommandWithOutput(consulLeaderCmd)
+	if leader = strings.Trim(strings.TrimSpace(leader), `"`); err == nil && leader != "" {
+		report.ConsulLeader = leader
+	}
+
+	if _, err := client.ExecuteCommandWithOutput("pgrep -x runner"); err == nil {
+		report.Runner = "running"
+	}
+
+	return report
+}
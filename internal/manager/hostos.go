@@ -0,0 +1,500 @@
+package manager
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/brimblehq/migration/internal/ssh"
+	"github.com/brimblehq/migration/internal/types"
+)
+
+// osFamily holds what differs between the supported distributions: the package
+// manager, package names and the repositories third-party packages come from.
+// Services are managed with systemctl everywhere.
+type osFamily struct {
+	name string // "debian", "rhel" or "amazon"
+	// pretty is the distribution as /etc/os-release names it.
+	pretty string
+	// id and version are the ID and VERSION_ID of /etc/os-release, empty
+	// when the host was not inspected.
+	id      string
+	version string
+	// codename is the release codename Debian-family repositories are
+	// published under, such as "jammy".
+	codename string
+	// distro picks among per-distribution repositories within a family, such
+	// as Docker's for Debian and Ubuntu.
+	distro string
+	pkg    string // "apt-get", "dnf", or "yum" where dnf is missing
+	query  string // checks that packages are installed
+	tools  []string
+	// firewall is ufw on Debian and firewalld elsewhere.
+	firewall string
+
+	redisPackage string
+	redisService string
+	redisServer  string
+}
+
+var debianFamily = osFamily{
+	name:         "debian",
+	pretty:       "Debian/Ubuntu",
+	distro:       "ubuntu",
+	pkg:          "apt-get",
+	query:        "dpkg -s",
+	tools:        []string{"curl", "unzip", "wget", "coreutils", "gpg", "debian-keyring", "debian-archive-keyring", "apt-transport-https"},
+	firewall:     "ufw",
+	redisPackage: "redis-server",
+	redisService: "redis-server",
+	redisServer:  "redis-server",
+}
+
+var rhelFamily = osFamily{
+	name:         "rhel",
+	pretty:       "RHEL",
+	pkg:          "dnf",
+	query:        "rpm -q",
+	tools:        []string{"curl", "unzip", "wget", "coreutils", "gnupg2", "tar", "dnf-plugins-core"},
+	firewall:     "firewalld",
+	redisPackage: "redis",
+	redisService: "redis",
+	redisServer:  "redis-server",
+}
+
+// amazonFamily is Amazon Linux 2023, which ships curl-minimal and packages
+// Redis as redis6.
+var amazonFamily = osFamily{
+	name:         "amazon",
+	pretty:       "Amazon Linux",
+	pkg:          "dnf",
+	query:        "rpm -q",
+	tools:        []string{"unzip", "wget", "coreutils", "gnupg2", "tar", "dnf-plugins-core"},
+	firewall:     "firewalld",
+	redisPackage: "redis6",
+	redisService: "redis6",
+	redisServer:  "redis6-server",
+}
+
+const osReleaseCommand = "cat /etc/os-release"
+
+const supportedDistros = "Ubuntu, Debian, RHEL, Rocky Linux, AlmaLinux, CentOS Stream 8+ and Amazon Linux 2023"
+
+// hostOS detects the distribution once per manager. Without an SSH client, as
+// when planning a host InspectHost could not reach, Debian/Ubuntu is assumed.
+func (im *InstallationManager) hostOS() (osFamily, error) {
+	if im.os != nil {
+		return *im.os, nil
+	}
+	if im.sshClient == nil {
+		return debianFamily, nil
+	}
+
+	family, err := readHostOS(im.sshClient)
+	if err != nil {
+		return osFamily{}, err
+	}
+
+	im.os = &family
+	return family, nil
+}
+
+// InspectHost detects the host's OS family and architecture through client
+// for a manager that has no SSH client of its own, as when planning. Nothing
+// else runs through client.
+func (im *InstallationManager) InspectHost(client *ssh.SSHClient) error {
+	family, err := readHostOS(client)
+	if err != nil {
+		return err
+	}
+
+	arch, err := readArchitecture(client)
+	if err != nil {
+		return err
+	}
+
+	im.os = &family
+	im.arch = arch
+	return nil
+}
+
+func readHostOS(client *ssh.SSHClient) (osFamily, error) {
+	output, err := client.ExecuteCommandWithOutput(osReleaseCommand)
+	if err != nil {
+		return osFamily{}, fmt.Errorf("failed to read /etc/os-release: %v", err)
+	}
+
+	family, err := detectOSFamily(output)
+	if err != nil {
+		return osFamily{}, err
+	}
+
+	if !family.debian() {
+		if _, err := client.ExecuteCommandWithOutput("command -v dnf"); err != nil {
+			family = family.withYum()
+		}
+	}
+
+	return family, nil
+}
+
+// detectOSFamily maps the contents of /etc/os-release to a supported family.
+func detectOSFamily(osRelease string) (osFamily, error) {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(osRelease, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if ok {
+			fields[key] = strings.Trim(value, `"'`)
+		}
+	}
+
+	id := fields["ID"]
+	like := strings.Fields(fields["ID_LIKE"])
+	version := fields["VERSION_ID"]
+	major, _ := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+
+	name := fields["PRETTY_NAME"]
+	if name == "" {
+		name = strings.TrimSpace(id + " " + version)
+	}
+
+	var family osFamily
+	switch {
+	case id == "debian" || id == "ubuntu" || contains(like, "debian") || contains(like, "ubuntu"):
+		family = debianFamily
+		if id == "debian" || (id != "ubuntu" && !contains(like, "ubuntu")) {
+			family.distro = "debian"
+		}
+	case id == "amzn":
+		if version != "2023" {
+			return osFamily{}, fmt.Errorf("unsupported operating system %s: only Amazon Linux 2023 is supported; supported systems are %s", name, supportedDistros)
+		}
+		family = amazonFamily
+	case id == "rhel" || id == "rocky" || id == "almalinux" || id == "centos" || id == "ol" || contains(like, "rhel"):
+		if major < 8 {
+			return osFamily{}, fmt.Errorf("unsupported operating system %s: RHEL-family hosts need version 8 or later; supported systems are %s", name, supportedDistros)
+		}
+		family = rhelFamily
+	default:
+		return osFamily{}, fmt.Errorf("unsupported operating system %s; supported systems are %s", name, supportedDistros)
+	}
+
+	if family.debian() {
+		// Derivatives such as Mint name the Ubuntu release they follow.
+		family.codename = fields["UBUNTU_CODENAME"]
+		if family.codename == "" {
+			family.codename = fields["VERSION_CODENAME"]
+		}
+		if family.codename == "" {
+			return osFamily{}, fmt.Errorf("unsupported operating system %s: /etc/os-release names no VERSION_CODENAME to pick package repositories by", name)
+		}
+	}
+
+	family.pretty = name
+	family.id = id
+	family.version = version
+	return family, nil
+}
+
+// release names the distribution and its version, such as "ubuntu-22.04",
+// or the family when the host was not inspected.
+func (f osFamily) release() string {
+	if f.id == "" {
+		return f.name
+	}
+	return strings.TrimSuffix(f.id+"-"+f.version, "-")
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Ports cluster members reach each other on: Nomad's HTTP, RPC and Serf ports
+// and the Consul agents' LAN gossip port.
+var (
+	nomadPorts = []string{
+		fmt.Sprintf("%d/tcp", nomadHTTPPort),
+		fmt.Sprintf("%d/tcp", nomadRPCPort),
+		fmt.Sprintf("%d/tcp", nomadSerfPort),
+		fmt.Sprintf("%d/udp", nomadSerfPort),
+	}
+	consulPorts = []string{"8301/tcp", "8301/udp"}
+)
+
+// firewallScope is who the cluster ports are opened to: traffic arriving on
+// iface when it is set, otherwise traffic from the sources addresses only.
+type firewallScope struct {
+	iface   string
+	sources []string
+}
+
+// openPorts allows ports, such as "4646/tcp", through the host's firewall when
+// it is running, to scope only. A firewall that is off is left off.
+func (f osFamily) openPorts(scope firewallScope, ports ...string) string {
+	var commands []string
+	if f.firewall == debianFamily.firewall {
+		for _, port := range ports {
+			number, proto, _ := strings.Cut(port, "/")
+			if scope.iface != "" {
+				commands = append(commands, fmt.Sprintf("sudo ufw allow in on %s to any port %s proto %s", scope.iface, number, proto))
+				continue
+			}
+			for _, source := range scope.sources {
+				commands = append(commands, fmt.Sprintf("sudo ufw allow from %s to any port %s proto %s", source, number, proto))
+			}
+		}
+		if len(commands) == 0 {
+			return "true"
+		}
+		return fmt.Sprintf("if sudo ufw status | grep -q 'Status: active'; then %s; fi", strings.Join(commands, " && "))
+	}
+
+	if scope.iface != "" {
+		// The trusted zone accepts everything arriving on the interface.
+		commands = append(commands, "sudo firewall-cmd --permanent --zone=trusted --add-interface="+scope.iface)
+	} else {
+		for _, port := range ports {
+			number, proto, _ := strings.Cut(port, "/")
+			for _, source := range scope.sources {
+				commands = append(commands, fmt.Sprintf(`sudo firewall-cmd --permanent --add-rich-rule='rule family="ipv4" source address="%s" port port="%s" protocol="%s" accept'`, source, number, proto))
+			}
+		}
+	}
+	if len(commands) == 0 {
+		return "true"
+	}
+	return fmt.Sprintf("if sudo firewall-cmd --state > /dev/null 2>&1; then %s && sudo firewall-cmd --reload; fi", strings.Join(commands, " && "))
+}
+
+func (f osFamily) debian() bool {
+	return f.name == debianFamily.name
+}
+
+// withYum swaps dnf for yum on hosts that only ship yum.
+func (f osFamily) withYum() osFamily {
+	f.pkg = "yum"
+	tools := make([]string, 0, len(f.tools))
+	for _, tool := range f.tools {
+		if tool == "dnf-plugins-core" {
+			tool = "yum-utils"
+		}
+		tools = append(tools, tool)
+	}
+	f.tools = tools
+	return f
+}
+
+// addRepo adds a repository from a downloaded .repo file.
+func (f osFamily) addRepo(url, name string, fetch *fetcher) []string {
+	file := fmt.Sprintf("/tmp/%s.repo", name)
+	command := fmt.Sprintf("sudo %s config-manager --add-repo %s", f.pkg, file)
+	if f.pkg == "yum" {
+		command = "sudo yum-config-manager --add-repo " + file
+	}
+	return append(fetch.fetch(url, file), command, "rm -f "+file)
+}
+
+func (f osFamily) refresh() string {
+	if f.debian() {
+		return "sudo apt-get update"
+	}
+	return fmt.Sprintf("sudo %s makecache -y", f.pkg)
+}
+
+func (f osFamily) upgrade() string {
+	return fmt.Sprintf("sudo %s upgrade -y", f.pkg)
+}
+
+func (f osFamily) install(packages ...string) string {
+	return fmt.Sprintf("sudo %s install -y %s", f.pkg, strings.Join(packages, " "))
+}
+
+func (f osFamily) remove(packages ...string) string {
+	return fmt.Sprintf("sudo %s remove -y %s || true", f.pkg, strings.Join(packages, " "))
+}
+
+// installFiles installs every package file in dir without reaching a repository.
+func (f osFamily) installFiles(dir string) string {
+	if f.debian() {
+		return fmt.Sprintf("sudo apt-get install -y --no-download %s/*.deb", dir)
+	}
+	return fmt.Sprintf("sudo %s install -y --disablerepo='*' %s/*.rpm", f.pkg, dir)
+}
+
+func (f osFamily) installed(packages ...string) string {
+	return fmt.Sprintf("%s %s > /dev/null", f.query, strings.Join(packages, " "))
+}
+
+// pin names a package at a version the way the package manager expects it.
+func (f osFamily) pin(name, version string) string {
+	version = strings.TrimPrefix(version, "v")
+	if f.debian() {
+		return fmt.Sprintf("%s=%s-1", name, version)
+	}
+	return fmt.Sprintf("%s-%s", name, version)
+}
+
+func (f osFamily) dockerCommands(versions types.Versions, arch string, fetch *fetcher) []string {
+	if f.name == amazonFamily.name {
+		return append([]string{
+			f.install(f.dockerPackages(versions.Docker)...),
+			"sudo systemctl enable --now docker",
+			"sudo usermod -aG docker $USER",
+		}, composePluginCommands(versions.Compose, arch, fetch)...)
+	}
+
+	commands := f.dockerRepo(fetch)
+	if f.debian() {
+		commands = append(commands, f.refresh())
+	}
+	return append(commands,
+		f.install(f.dockerPackages(versions.Docker)...),
+		"sudo systemctl enable --now docker",
+		"sudo usermod -aG docker $USER",
+	)
+}
+
+// dockerRepo adds Docker's own package repository. Amazon Linux packages
+// Docker itself.
+func (f osFamily) dockerRepo(fetch *fetcher) []string {
+	switch f.name {
+	case rhelFamily.name:
+		return f.addRepo("https://download.docker.com/linux/centos/docker-ce.repo", "docker-ce", fetch)
+	case amazonFamily.name:
+		return nil
+	}
+
+	commands := []string{"sudo install -m 0755 -d /etc/apt/keyrings"}
+	commands = append(commands, fetch.fetch(fmt.Sprintf("https://download.docker.com/linux/%s/gpg", f.distro), "/tmp/docker.asc")...)
+	return append(commands, "sudo mv /tmp/docker.asc /etc/apt/keyrings/docker.asc")
+}
+
+// repoFile is a package repository definition, rendered locally and written
+// to the host before the commands that use it.
+type repoFile struct {
+	path    string
+	content string
+}
+
+// dockerRepoFiles is the apt source dockerRepo's key signs.
+func (f osFamily) dockerRepoFiles(arch string) []repoFile {
+	if !f.debian() {
+		return nil
+	}
+	return []repoFile{{
+		path:    "/etc/apt/sources.list.d/docker.list",
+		content: fmt.Sprintf("deb [arch=%s signed-by=/etc/apt/keyrings/docker.asc] https://download.docker.com/linux/%s %s stable\n", arch, f.distro, f.codename),
+	}}
+}
+
+// dockerPackages names the Docker packages from dockerRepo, pinned to version.
+func (f osFamily) dockerPackages(version string) []string {
+	if f.name == amazonFamily.name {
+		if pinned(version) {
+			return []string{fmt.Sprintf("'docker-%s*'", version)}
+		}
+		return []string{"docker"}
+	}
+
+	packages := []string{"docker-ce", "docker-ce-cli", "containerd.io", "docker-compose-plugin"}
+	if pinned(version) {
+		format := "'%s-%s*'"
+		if f.debian() {
+			format = "'%s=5:%s*'"
+		}
+		packages[0] = fmt.Sprintf(format, "docker-ce", version)
+		packages[1] = fmt.Sprintf(format, "docker-ce-cli", version)
+	}
+	return packages
+}
+
+func composeURL(version, arch string) string {
+	return fmt.Sprintf("https://github.com/docker/compose/releases/download/v%s/docker-compose-linux-%s", version, unameArch(arch))
+}
+
+// composePluginCommands install the Compose CLI plugin where no package ships it.
+func composePluginCommands(version, arch string, fetch *fetcher) []string {
+	return append(fetch.fetch(composeURL(version, arch), "/tmp/docker-compose"),
+		"sudo install -D -m 0755 /tmp/docker-compose /usr/local/lib/docker/cli-plugins/docker-compose",
+		"rm -f /tmp/docker-compose",
+	)
+}
+
+// nodeSourceRepo is NodeSource's yum repository for a release line; $basearch
+// is left for dnf to fill in.
+const nodeSourceRepo = `[nodesource-nodejs]
+name=Node.js Packages for Enterprise Linux
+baseurl=https://rpm.nodesource.com/pub_%s/nodistro/nodejs/$basearch
+enabled=1
+gpgcheck=1
+module_hotfixes=1
+`
+
+// nodeSourceSetup adds NodeSource's repository for a release line such as
+// "20.x", trusting only its signing key.
+func (f osFamily) nodeSourceSetup(line string, fetch *fetcher) []string {
+	if !f.debian() {
+		return append(fetch.fetch("https://rpm.nodesource.com/gpgkey/ns-operations-public.key", "/tmp/nodesource.key"),
+			"sudo rpm --import /tmp/nodesource.key",
+			"rm -f /tmp/nodesource.key",
+			f.refresh(),
+		)
+	}
+
+	commands := []string{"sudo install -m 0755 -d /etc/apt/keyrings"}
+	commands = append(commands, fetch.fetch("https://deb.nodesource.com/gpgkey/nodesource-repo.gpg.key", "/tmp/nodesource.key")...)
+	return append(commands,
+		"sudo gpg --batch --yes --dearmor -o /etc/apt/keyrings/nodesource.gpg /tmp/nodesource.key",
+		"rm -f /tmp/nodesource.key",
+		f.refresh(),
+	)
+}
+
+// nodeSourceRepoFiles is the repository nodeSourceSetup refreshes.
+func (f osFamily) nodeSourceRepoFiles(line string) []repoFile {
+	if !f.debian() {
+		return []repoFile{{path: "/etc/yum.repos.d/nodesource-nodejs.repo", content: fmt.Sprintf(nodeSourceRepo, line)}}
+	}
+	return []repoFile{{
+		path:    "/etc/apt/sources.list.d/nodesource.list",
+		content: fmt.Sprintf("deb [signed-by=/etc/apt/keyrings/nodesource.gpg] https://deb.nodesource.com/node_%s nodistro main\n", line),
+	}}
+}
+
+func (f osFamily) infisicalSetup(fetch *fetcher) []string {
+	url := "https://dl.cloudsmith.io/public/infisical/infisical-cli/setup.deb.sh"
+	if !f.debian() {
+		url = "https://dl.cloudsmith.io/public/infisical/infisical-cli/setup.rpm.sh"
+	}
+	return append(fetch.fetch(url, "/tmp/infisical-setup.sh"), "sudo -E bash /tmp/infisical-setup.sh", "rm -f /tmp/infisical-setup.sh")
+}
+
+func (f osFamily) hashicorpRepo(fetch *fetcher) []string {
+	switch f.name {
+	case rhelFamily.name:
+		return f.addRepo("https://rpm.releases.hashicorp.com/RHEL/hashicorp.repo", "hashicorp", fetch)
+	case amazonFamily.name:
+		return f.addRepo("https://rpm.releases.hashicorp.com/AmazonLinux/hashicorp.repo", "hashicorp", fetch)
+	}
+
+	return append(fetch.fetch("https://apt.releases.hashicorp.com/gpg", "/tmp/hashicorp.gpg"),
+		"sudo gpg --batch --yes --dearmor -o /usr/share/keyrings/hashicorp-archive-keyring.gpg /tmp/hashicorp.gpg",
+		"sudo rm /tmp/hashicorp.gpg",
+	)
+}
+
+// hashicorpRepoFiles is the apt source hashicorpRepo's key signs.
+func (f osFamily) hashicorpRepoFiles(arch string) []repoFile {
+	if !f.debian() {
+		return nil
+	}
+	return []repoFile{{
+		path:    "/etc/apt/sources.list.d/hashicorp.list",
+		content: fmt.Sprintf("deb [arch=%s signed-by=/usr/share/keyrings/hashicorp-archive-keyring.gpg] https://apt.releases.hashicorp.com %s main\n", arch, f.codename),
+	}}
+}
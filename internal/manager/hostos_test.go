@@ -0,0 +1,95 @@
+package manager
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/brimblehq/migration/internal/types"
+)
+
+func TestOpenPorts(t *testing.T) {
+	peers := firewallScope{sources: []string{"10.0.0.1", "10.0.0.2"}}
+	tailnet := firewallScope{iface: tailscaleInterface}
+
+	tests := []struct {
+		name   string
+		family osFamily
+		scope  firewallScope
+		want   string
+	}{
+		{
+			name:   "ufw peers",
+			family: debianFamily,
+			scope:  peers,
+			want:   "if sudo ufw status | grep -q 'Status: active'; then sudo ufw allow from 10.0.0.1 to any port 4646 proto tcp && sudo ufw allow from 10.0.0.2 to any port 4646 proto tcp; fi",
+		},
+		{
+			name:   "ufw tailscale",
+			family: debianFamily,
+			scope:  tailnet,
+			want:   "if sudo ufw status | grep -q 'Status: active'; then sudo ufw allow in on tailscale0 to any port 4646 proto tcp; fi",
+		},
+		{
+			name:   "firewalld peers",
+			family: rhelFamily,
+			scope:  peers,
+			want: `if sudo firewall-cmd --state > /dev/null 2>&1; then ` +
+				`sudo firewall-cmd --permanent --add-rich-rule='rule family="ipv4" source address="10.0.0.1" port port="4646" protocol="tcp" accept' && ` +
+				`sudo firewall-cmd --permanent --add-rich-rule='rule family="ipv4" source address="10.0.0.2" port port="4646" protocol="tcp" accept' && ` +
+				`sudo firewall-cmd --reload; fi`,
+		},
+		{
+			name:   "firewalld tailscale",
+			family: rhelFamily,
+			scope:  tailnet,
+			want:   "if sudo firewall-cmd --state > /dev/null 2>&1; then sudo firewall-cmd --permanent --zone=trusted --add-interface=tailscale0 && sudo firewall-cmd --reload; fi",
+		},
+		{
+			name:   "no peers",
+			family: debianFamily,
+			want:   "true",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.family.openPorts(tt.scope, "4646/tcp"); got != tt.want {
+				t.Errorf("openPorts() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirewallScope(t *testing.T) {
+	servers := []types.Server{
+		{Host: "a", PrivateIP: "10.0.0.1", PublicIP: "203.0.113.1"},
+		{Host: "b", PrivateIP: "10.0.0.2", PublicIP: "203.0.113.2"},
+	}
+
+	tests := []struct {
+		mode    types.NetworkMode
+		sources []string
+		iface   string
+	}{
+		{mode: "", sources: []string{"203.0.113.1", "203.0.113.2"}},
+		{mode: types.NetworkPrivate, sources: []string{"10.0.0.1", "10.0.0.2"}},
+		{mode: types.NetworkTailscale, iface: tailscaleInterface},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			im := &InstallationManager{
+				server: servers[0],
+				config: &types.Config{Servers: servers, ClusterConfig: types.ClusterConfig{NetworkMode: tt.mode}},
+			}
+
+			scope, err := im.firewallScope()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if scope.iface != tt.iface || !reflect.DeepEqual(scope.sources, tt.sources) {
+				t.Errorf("scope = %+v, want iface %q and sources %q", scope, tt.iface, tt.sources)
+			}
+		})
+	}
+}
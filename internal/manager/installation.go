@@ -1,6 +1,7 @@
 package manager
 
 import (
+	"context"
 	"embed"
 	"fmt"
 	"log"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/brimblehq/migration/assets"
 	"github.com/brimblehq/migration/internal/db"
+	"github.com/brimblehq/migration/internal/retry"
 	"github.com/brimblehq/migration/internal/ssh"
 	"github.com/brimblehq/migration/internal/types"
 )
@@ -22,13 +24,30 @@ type InstallationManager struct {
 	files          embed.FS
 	tailScaleToken string
 	DB             *db.PostgresDB
+	cluster        *ClusterManager
+	// os is detected on first use; see hostOS.
+	os *osFamily
+	// arch is detected on first use; see Architecture.
+	arch string
+	// downloads is the download manifest, read on first use; see fetcher.
+	downloads types.Downloads
+	// addr is resolved on first use; see ClusterAddress.
+	addr string
 }
 
-func NewInstallationManager(client *ssh.SSHClient, server types.Server, roles []types.ClusterRole, config *types.Config, tailScaleToken string, db *db.PostgresDB) *InstallationManager {
+// NewInstallationManager prepares the steps for one server. cluster may be nil for
+// operations that do not render Nomad configuration, such as teardown.
+func NewInstallationManager(client *ssh.SSHClient, server types.Server, cluster *ClusterManager, config *types.Config, tailScaleToken string, db *db.PostgresDB) *InstallationManager {
+	var roles []types.ClusterRole
+	if cluster != nil {
+		roles = cluster.GetServerRoles(server.Host)
+	}
+
 	return &InstallationManager{
 		sshClient:      client,
 		server:         server,
 		roles:          roles,
+		cluster:        cluster,
 		config:         config,
 		files:          assets.MonitoringFiles,
 		tailScaleToken: tailScaleToken,
@@ -36,74 +55,7 @@ func NewInstallationManager(client *ssh.SSHClient, server types.Server, roles []
 	}
 }
 
-func (im *InstallationManager) InstallBasePackages() error {
-	commands := []string{
-		"sudo apt-get update",
-		"sudo apt-get upgrade -y",
-		"sudo apt install -y curl unzip wget ufw coreutils gpg debian-keyring debian-archive-keyring apt-transport-https",
-		"sudo apt update -y",
-
-		// Tailscale installation
-		fmt.Sprintf("curl -fsSL https://tailscale.com/install.sh | sh && sudo tailscale up --auth-key=%s", im.tailScaleToken),
-
-		// Docker installation
-		"curl -fsSL https://get.docker.com -o get-docker.sh",
-		"sudo sh get-docker.sh",
-		"sudo usermod -aG docker $USER",
-		"sudo apt install -y docker-compose",
-
-		// Node.js installation
-		fmt.Sprintf("curl -fsSL https://deb.nodesource.com/setup_%s | sudo -E bash -", im.config.ClusterConfig.Versions.NodeJS),
-		"sudo apt-get install -y nodejs",
-
-		// Redis installation
-		"apt-get install -y redis-server",
-		"systemctl enable redis-server",
-		"systemctl start redis-server",
-
-		// NVM installation and initialization
-		"curl -o- https://raw.githubusercontent.com/nvm-sh/nvm/v0.40.1/install.sh | bash",
-		"export NVM_DIR=\"$HOME/.nvm\" && [ -s \"$NVM_DIR/nvm.sh\" ] && . \"$NVM_DIR/nvm.sh\" && [ -s \"$NVM_DIR/bash_completion\" ] && . \"$NVM_DIR/bash_completion\" && nvm install 20 && nvm use 20",
-
-		// Global npm tools
-		"/root/.nvm/versions/node/v20.18.1/bin/npm install --global yarn",
-		"/root/.nvm/versions/node/v20.18.1/bin/npm install -g pm2",
-
-		// Infisical CLI installation
-		"curl -1sLf 'https://dl.cloudsmith.io/public/infisical/infisical-cli/setup.deb.sh' | sudo -E bash",
-		"sudo apt-get update && sudo apt-get install -y infisical",
-
-		// Nixpacks installation
-		"curl -sSL https://nixpacks.com/install.sh | bash",
-
-		// Nomad Installation:
-		"curl -fsSL https://apt.releases.hashicorp.com/gpg | sudo tee /tmp/hashicorp.gpg > /dev/null",
-		"sudo gpg --batch --yes --dearmor -o /usr/share/keyrings/hashicorp-archive-keyring.gpg /tmp/hashicorp.gpg",
-		"sudo rm /tmp/hashicorp.gpg",
-		"echo \"deb [arch=$(dpkg --print-architecture) signed-by=/usr/share/keyrings/hashicorp-archive-keyring.gpg] https://apt.releases.hashicorp.com $(lsb_release -cs) main\" | sudo tee /etc/apt/sources.list.d/hashicorp.list",
-		"sudo apt update && sudo apt install -y nomad",
-		"sudo apt-get install -y consul-cni",
-
-		// Brimble runner installation
-		"curl -fsSL https://cdn.brimble.io/runner-linux -o runner.sh",
-		"sudo chmod +x runner.sh",
-		"sudo mv runner.sh /usr/local/bin/runner",
-
-		// CNI plugins installation
-		"ARCH_CNI=$( [ $(uname -m) = aarch64 ] && echo arm64 || echo amd64) && CNI_PLUGIN_VERSION=v1.5.1 && curl -L -o cni-plugins.tgz \"https://github.com/containernetworking/plugins/releases/download/${CNI_PLUGIN_VERSION}/cni-plugins-linux-${ARCH_CNI}-${CNI_PLUGIN_VERSION}.tgz\" && sudo mkdir -p /opt/cni/bin && sudo tar -C /opt/cni/bin -xzf cni-plugins.tgz",
-	}
-
-	for _, cmd := range commands {
-		if err := im.sshClient.ExecuteCommand(cmd); err != nil {
-			return fmt.Errorf("failed to execute command %q: %v", cmd, err)
-		}
-	}
-	return nil
-}
-
-func (im *InstallationManager) SetupConsulClient() error {
-	serverHost := strings.Split(im.config.ClusterConfig.ConsulConfig.ServerAddress, ":")[0]
-
+func (im *InstallationManager) SetupConsulClient(ctx context.Context, machineID string) error {
 	checkCmd := "docker ps -a --format '{{.Names}}' | grep -w consul-client || true"
 
 	output, err := im.sshClient.ExecuteCommandWithOutput(checkCmd)
@@ -131,7 +83,68 @@ func (im *InstallationManager) SetupConsulClient() error {
 		return fmt.Errorf("failed to setup consul container: %v", err)
 	}
 
-	runCmd := fmt.Sprintf(`docker run -d \
+	addr, err := im.ClusterAddress()
+	if err != nil {
+		return err
+	}
+
+	host, err := im.hostOS()
+	if err != nil {
+		return err
+	}
+
+	scope, err := im.firewallScope()
+	if err != nil {
+		return err
+	}
+
+	if err := im.sshClient.ExecuteCommand(host.openPorts(scope, consulPorts...)); err != nil {
+		return fmt.Errorf("failed to open consul ports: %v", err)
+	}
+
+	runCmd := im.consulRunCommand(nodeName, addr)
+
+	if err := im.sshClient.ExecuteCommand(runCmd); err != nil {
+		return fmt.Errorf("failed to start consul container: %v", err)
+	}
+
+	policy := waitPolicy(consulReadyPolicy, im.config.Timeouts.ConsulReady)
+	err = retry.Do(ctx, policy, func(int) error {
+		output, err := im.sshClient.ExecuteCommandWithOutput(consulLeaderCmd)
+		if err != nil {
+			return err
+		}
+		if output == "" {
+			return fmt.Errorf("no consul leader yet")
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("consul client failed to become ready: %v", err)
+	}
+
+	output, err = im.sshClient.ExecuteCommandWithOutput(consulVersionCmd)
+	if err != nil {
+		return fmt.Errorf("failed to read consul version: %v", err)
+	}
+
+	version := strings.TrimSpace(strings.SplitN(strings.TrimSpace(output), "\n", 2)[0])
+	if !versionMatches(version, im.versions().Consul) {
+		return fmt.Errorf("consul client reports %q, want %s", version, im.versions().Consul)
+	}
+
+	return im.DB.RecordComponent(machineID, "consul", version)
+}
+
+const (
+	consulLeaderCmd  = "curl -s http://localhost:8500/v1/status/leader || true"
+	consulVersionCmd = "docker exec consul-client consul version"
+)
+
+func (im *InstallationManager) consulRunCommand(nodeName, addr string) string {
+	serverHost := strings.Split(im.config.ClusterConfig.ConsulConfig.ServerAddress, ":")[0]
+
+	return fmt.Sprintf(`docker run -d \
         --name consul-client \
         --network host \
         --restart unless-stopped \
@@ -141,27 +154,12 @@ func (im *InstallationManager) SetupConsulClient() error {
         -client=0.0.0.0 \
         -bind=%s \
         -datacenter=%s`,
-		im.config.ClusterConfig.ConsulConfig.ConsulImage,
+		im.consulImage(),
 		nodeName,
 		serverHost,
-		im.server.PublicIP,
+		addr,
 		im.config.ClusterConfig.ConsulConfig.DataCenter,
 	)
-
-	if err := im.sshClient.ExecuteCommand(runCmd); err != nil {
-		return fmt.Errorf("failed to start consul container: %v", err)
-	}
-
-	checkConsulCmd := "curl -s http://localhost:8500/v1/status/leader || true"
-	for i := 0; i < 30; i++ {
-		output, err := im.sshClient.ExecuteCommandWithOutput(checkConsulCmd)
-		if err == nil && output != "" {
-			return nil
-		}
-		time.Sleep(2 * time.Second)
-	}
-
-	return fmt.Errorf("consul client failed to become ready")
 }
 
 func (im *InstallationManager) getMachineNodeName() (string, error) {
@@ -170,136 +168,41 @@ func (im *InstallationManager) getMachineNodeName() (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("failed to get machine-id: %v", err)
 	}
-	nodeName := fmt.Sprintf("nomad-client-%s", strings.TrimSpace(machineID[:10]))
 
-	return nodeName, nil
+	return machineNodeName(machineID), nil
 }
 
-func (im *InstallationManager) getServerCount() int {
-	totalNodes := len(im.config.Servers)
-	switch totalNodes {
-	case 1, 2:
-		return 1
-	default:
-		return totalNodes - 1
+func machineNodeName(machineID string) string {
+	if len(machineID) < 10 {
+		return fmt.Sprintf("nomad-client-%s", strings.TrimSpace(machineID))
 	}
+	return fmt.Sprintf("nomad-client-%s", strings.TrimSpace(machineID[:10]))
 }
 
-func (im *InstallationManager) getNomadServerAddresses() []string {
-	var servers []string
-	numServers := im.getServerCount()
-	for i := 0; i < numServers; i++ {
-		//use tailscale private ip in production
-		serverIP := im.config.Servers[i].PublicIP
-		servers = append(servers, fmt.Sprintf("%s:4647", serverIP))
-	}
-	return servers
+// IsServer reports whether this host runs a Nomad server.
+func (im *InstallationManager) IsServer() bool {
+	return HasRole(im.roles, types.RoleServer)
 }
 
-func quoteServerAddresses(addresses []string) []string {
-	quoted := make([]string, len(addresses))
-	for i, addr := range addresses {
-		quoted[i] = fmt.Sprintf(`"%s"`, addr)
-	}
-	return quoted
+func (im *InstallationManager) getServerCount() int {
+	return im.cluster.ServerNodes
 }
 
-func (im *InstallationManager) SetupNomad() error {
+func (im *InstallationManager) SetupNomad(ctx context.Context) error {
 	if err := im.cleanupNomadState(); err != nil {
 		return fmt.Errorf("failed to cleanup nomad state: %v", err)
 	}
 
-	var serverBlock, clientBlock string
-
 	nodeName, err := im.getMachineNodeName()
 
 	if err != nil {
 		return fmt.Errorf("failed to setup consul container: %v", err)
 	}
 
-	isServer := false
-	isClient := false
-	for _, role := range im.roles {
-		if role == types.RoleServer {
-			isServer = true
-		}
-		if role == types.RoleClient {
-			isClient = true
-		}
-	}
-
-	var nomadConfig string
-
-	if len(im.config.Servers) == 1 {
-		nomadConfig = im.getSingleNodeConfig(nodeName)
-	} else {
-		if isServer {
-			serverBlock = fmt.Sprintf(`
-	server {
-		enabled = true
-		bootstrap_expect = %d
-	}`, im.getServerCount())
-		}
-
-		if isClient {
-			clientBlock = fmt.Sprintf(`
-	client {
-		enabled = true
-		servers = [%s]
-	}`, strings.Join(quoteServerAddresses(im.getNomadServerAddresses()), ", "))
-		}
-
-		nomadConfig = fmt.Sprintf(`
-	datacenter = "%s"
-	data_dir = "/opt/nomad/data"
-	bind_addr = "%s"
-	
-	advertise {
-		http = "%s:4646"
-		rpc = "%s:4647"
-		serf = "%s:4648"
-	}
-	%s
-	%s
-	
-	consul {
-		address = "127.0.0.1:8500"
-		token = "%s"
-		client_service_name = "%s"
-		auto_advertise = true
-		server_auto_join = true
-		client_auto_join = true
-	}
-	
-	plugin "docker" {
-		config {
-			allow_privileged = true
-			volumes {
-				enabled = true
-			}
-		}
+	model, nomadConfig, err := im.nomadConfig(nodeName)
+	if err != nil {
+		return err
 	}
-	
-	telemetry {
-		collection_interval = "1s"
-		disable_hostname = true
-		prometheus_metrics = true
-		publish_allocation_metrics = true
-		publish_node_metrics = true
-	}`,
-			im.config.ClusterConfig.ConsulConfig.DataCenter,
-			im.server.PublicIP,
-			im.server.PublicIP,
-			im.server.PublicIP,
-			im.server.PublicIP,
-			serverBlock,
-			clientBlock,
-			im.config.ClusterConfig.ConsulConfig.Token,
-			nodeName,
-		)
-	}
-
-	//use tailscale private ip in production
 
 	fmt.Println(nomadConfig)
 
@@ -325,29 +228,49 @@ func (im *InstallationManager) SetupNomad() error {
 		}
 	}
 
-	commands := []string{
-		"sudo mkdir -p /etc/nomad.d",
-		fmt.Sprintf(`echo '%s' | sudo tee /etc/nomad.d/nomad.hcl`, nomadConfig),
+	host, err := im.hostOS()
+	if err != nil {
+		return err
 	}
 
-	for _, cmd := range commands {
+	scope, err := im.firewallScope()
+	if err != nil {
+		return err
+	}
+
+	for _, cmd := range append([]string{host.openPorts(scope, nomadPorts...), "sudo mkdir -p /etc/nomad.d"}, hostVolumeCommands(model)...) {
 		if err := im.sshClient.ExecuteCommand(cmd); err != nil {
 			return err
 		}
 	}
 
+	if err := im.sshClient.WriteFile("/etc/nomad.d/nomad.hcl", []byte(nomadConfig), ssh.FileOptions{Mode: 0644, Sudo: true}); err != nil {
+		return err
+	}
+
 	for _, cmd := range serviceCommands {
 		if err := im.sshClient.ExecuteCommand(cmd); err != nil {
 			return err
 		}
 	}
 
-	if err := im.checkNomadHealth(); err != nil {
+	if err := im.checkNomadHealth(ctx); err != nil {
 		return fmt.Errorf("failed to verify nomad health: %v", err)
 	}
 	return nil
 }
 
+var nomadStateCleanupCommands = []string{
+	"for m in $(mount | grep nomad | awk '{print $3}'); do sudo umount $m || true; done",
+	"sudo rm -rf /opt/nomad/data/*",
+	"sudo rm -rf /opt/nomad/data/server/raft/*",
+	"sudo rm -f /etc/nomad.d/nomad.hcl",
+	"sudo mkdir -p /opt/nomad/data/server",
+	"sudo mkdir -p /opt/nomad/data/client",
+	"sudo mkdir -p /opt/nomad/data/alloc",
+	"sudo chmod -R 700 /opt/nomad/data",
+}
+
 func (im *InstallationManager) cleanupNomadState() error {
 	checkCmd := "systemctl is-active nomad || true"
 	status, err := im.sshClient.ExecuteCommandWithOutput(checkCmd)
@@ -356,8 +279,13 @@ func (im *InstallationManager) cleanupNomadState() error {
 	}
 
 	if strings.TrimSpace(status) == "active" {
+		token, err := im.managementToken()
+		if err != nil {
+			return err
+		}
+
 		stopJobsCmd := "nomad job stop -purge -yes -detach '*'"
-		if err := im.sshClient.ExecuteCommand(stopJobsCmd); err != nil {
+		if err := im.sshClient.ExecuteCommand(withNomadToken(token, stopJobsCmd)); err != nil {
 			log.Printf("Note: Failed to stop nomad jobs: %v", err)
 		}
 
@@ -378,18 +306,7 @@ func (im *InstallationManager) cleanupNomadState() error {
 		time.Sleep(2 * time.Second)
 	}
 
-	commands := []string{
-		"for m in $(mount | grep nomad | awk '{print $3}'); do sudo umount $m || true; done",
-		"sudo rm -rf /opt/nomad/data/*",
-		"sudo rm -rf /opt/nomad/data/server/raft/*",
-		"sudo rm -f /etc/nomad.d/nomad.hcl",
-		"sudo mkdir -p /opt/nomad/data/server",
-		"sudo mkdir -p /opt/nomad/data/client",
-		"sudo mkdir -p /opt/nomad/data/alloc",
-		"sudo chmod -R 700 /opt/nomad/data",
-	}
-
-	for _, cmd := range commands {
+	for _, cmd := range nomadStateCleanupCommands {
 		if err := im.sshClient.ExecuteCommand(cmd); err != nil {
 			return fmt.Errorf("failed to execute cleanup command %q: %v", cmd, err)
 		}
@@ -397,108 +314,95 @@ func (im *InstallationManager) cleanupNomadState() error {
 	return nil
 }
 
-func (im *InstallationManager) checkNomadHealth() error {
-	maxRetries := 20
-	for i := 0; i < maxRetries; i++ {
+func (im *InstallationManager) checkNomadHealth(ctx context.Context) error {
+	policy := waitPolicy(nomadHealthyPolicy, im.config.Timeouts.NomadHealthy)
+	err := retry.Do(ctx, policy, func(int) error {
 		statusCmd := "systemctl is-active nomad"
 		status, _ := im.sshClient.ExecuteCommandWithOutput(statusCmd)
 		if strings.TrimSpace(status) != "active" {
-			time.Sleep(2 * time.Second)
-			continue
+			return fmt.Errorf("nomad service is %s", strings.TrimSpace(status))
 		}
 
 		logsCmd := `journalctl -u nomad --since '30 seconds ago' | grep -i error | grep -v "client.host_stats" | grep -v "failed to find disk usage" || true`
 		logs, _ := im.sshClient.ExecuteCommandWithOutput(logsCmd)
+		if logs != "" {
+			return fmt.Errorf("nomad logged errors in the last 30 seconds")
+		}
 
-		if logs == "" {
-			healthCmd := "curl -s http://127.0.0.1:4646/v1/agent/health"
-			health, err := im.sshClient.ExecuteCommandWithOutput(healthCmd)
-			if err == nil && strings.Contains(health, "ok") {
-				isServer := false
-				for _, role := range im.roles {
-					if role == types.RoleServer {
-						isServer = true
-						break
-					}
-				}
-
-				if isServer {
-					serverCmd := "nomad server members"
-					_, err := im.sshClient.ExecuteCommandWithOutput(serverCmd)
-					if err != nil {
-						time.Sleep(2 * time.Second)
-						continue
-					}
-				}
-				return nil
-			}
+		healthCmd := "curl -s http://127.0.0.1:4646/v1/agent/health"
+		health, err := im.sshClient.ExecuteCommandWithOutput(healthCmd)
+		if err != nil || !strings.Contains(health, "ok") {
+			return fmt.Errorf("nomad agent is not healthy yet")
 		}
 
-		time.Sleep(2 * time.Second)
+		// Before ACLs are bootstrapped, or after the Nomad state they were
+		// bootstrapped in was wiped, the servers cannot be listed; the leader
+		// check that follows covers them.
+		token, err := im.managementToken()
+		if err != nil {
+			return err
+		}
+		if token != "" {
+			if rejected, err := im.tokenRejected(token); err != nil || rejected {
+				token = ""
+			}
+		}
+		if im.IsServer() && (token != "" || !im.aclEnabled()) {
+			serverCmd := "nomad server members"
+			if _, err := im.sshClient.ExecuteCommandWithOutput(withNomadToken(token, serverCmd)); err != nil {
+				return fmt.Errorf("nomad server members failed: %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("nomad failed to become healthy within %s: %v", policy.Budget(), err)
 	}
 
-	return fmt.Errorf("nomad failed to become healthy after %d seconds", maxRetries*2)
+	return nil
 }
 
-func (im *InstallationManager) getSingleNodeConfig(nodeName string) string {
-	return fmt.Sprintf(`
- data_dir = "/opt/nomad/data"
- 
- log_level = "INFO"
- 
- server {
-	enabled = true
-	bootstrap_expect = 1
- }
- 
- client {
-	enabled = true
-	servers = ["127.0.0.1:4647"]
- }
- 
- addresses {
-	http = "0.0.0.0"
- }
- 
- ports {
-	http = 4646
-	rpc  = 4647
-	serf = 4648
- }
- 
- consul {
-	address = "127.0.0.1:8500"
-	token = "%s"
-	client_service_name = "%s"
-	auto_advertise = true
-	server_auto_join = true
-	client_auto_join = true
- }
- 
- plugin "docker" {
-	config {
-		allow_privileged = true
-		volumes {
-			enabled = true
+const nomadLeaderCmd = "curl -s http://127.0.0.1:4646/v1/status/leader || true"
+
+// WaitForNomadLeader polls the local Nomad server until the servers have elected a leader.
+func (im *InstallationManager) WaitForNomadLeader(ctx context.Context) error {
+	policy := waitPolicy(nomadLeaderPolicy, im.config.Timeouts.NomadLeader)
+	err := retry.Do(ctx, policy, func(int) error {
+		output, err := im.sshClient.ExecuteCommandWithOutput(nomadLeaderCmd)
+		if err != nil {
+			return err
+		}
+		if strings.Trim(strings.TrimSpace(output), `"`) == "" {
+			return fmt.Errorf("no leader yet")
 		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("nomad servers did not elect a leader within %s: %v", policy.Budget(), err)
 	}
- }
- 
- telemetry {
-	collection_interval = "1s"
-	disable_hostname = true
-	prometheus_metrics = true
-	publish_allocation_metrics = true
-	publish_node_metrics = true
- }`, im.config.ClusterConfig.ConsulConfig.Token, nodeName)
+
+	return nil
+}
+
+func (im *InstallationManager) StartRunner(ctx context.Context, licenseToken string, instances string) error {
+	command, err := runnerCommand(licenseToken, instances)
+	if err != nil {
+		return err
+	}
+
+	token, err := im.nomadToken(nomadRunnerSecret)
+	if err != nil {
+		return err
+	}
+
+	return im.sshClient.ExecuteCommandContext(ctx, withNomadToken(token, command))
 }
 
-func (im *InstallationManager) StartRunner(licenseToken string, instances string) error {
+func runnerCommand(licenseToken string, instances string) (string, error) {
 	instanceCount, err := strconv.Atoi(instances)
 	if err != nil {
-		return fmt.Errorf("invalid instances value: %v", err)
+		return "", fmt.Errorf("invalid instances value: %v", err)
 	}
 
-	command := fmt.Sprintf("runner --license-key=%s --instances=%d", licenseToken, instanceCount)
-	return im.sshClient.ExecuteCommand(command)
+	return fmt.Sprintf("runner --license-key=%s --instances=%d", licenseToken, instanceCount), nil
 }
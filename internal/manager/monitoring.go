@@ -1,16 +1,23 @@
 package manager
 
 import (
-	"encoding/base64"
+	"context"
 	"fmt"
 	"path/filepath"
 	"sort"
 	"strings"
-	"time"
+
+	"github.com/brimblehq/migration/internal/retry"
+	"github.com/brimblehq/migration/internal/ssh"
 )
 
-func (im *InstallationManager) SetupMonitoring() error {
-	if err := im.waitForNomadCluster(); err != nil {
+func (im *InstallationManager) SetupMonitoring(ctx context.Context) error {
+	token, err := im.nomadToken(nomadMonitoringSecret)
+	if err != nil {
+		return err
+	}
+
+	if err := im.waitForNomadCluster(ctx, token); err != nil {
 		return fmt.Errorf("nomad not ready: %v", err)
 	}
 
@@ -19,9 +26,59 @@ func (im *InstallationManager) SetupMonitoring() error {
 		return fmt.Errorf("failed to get machine-id: %v", err)
 	}
 
+	orderedJobs, err := im.selectedMonitoringJobs()
+	if err != nil {
+		return err
+	}
+
+	archs, err := im.clusterArchitectures()
+	if err != nil {
+		return err
+	}
+
+	for _, jobName := range orderedJobs {
+		fmt.Printf("Deploying %s...\n", jobName)
+
+		jobContent, err := im.files.ReadFile(filepath.Join("monitoring", jobName))
+		if err != nil {
+			return fmt.Errorf("failed to read job file %s: %v", jobName, err)
+		}
+
+		// Bundled images are loaded on every host, and the bundle's architecture
+		// was checked against the host's when it was unpacked.
+		if im.config.Bundle == "" {
+			if err := im.checkImagePlatforms(jobName, string(jobContent), archs); err != nil {
+				return err
+			}
+		}
+
+		modifiedJob := im.modifyServiceName(string(jobContent), machineID)
+
+		tempFile := fmt.Sprintf("/tmp/%s", jobName)
+		if err := im.sshClient.WriteFile(tempFile, []byte(modifiedJob), ssh.FileOptions{Mode: 0644}); err != nil {
+			return fmt.Errorf("failed to create job file: %v", err)
+		}
+
+		if err := im.sshClient.ExecuteCommand(withNomadToken(token, fmt.Sprintf("nomad job run %s", tempFile))); err != nil {
+			return fmt.Errorf("failed to run job %s: %v", jobName, err)
+		}
+
+		if err := im.waitForJobHealth(ctx, jobName, token); err != nil {
+			return fmt.Errorf("job %s failed to become healthy: %v", jobName, err)
+		}
+
+		fmt.Printf("%s deployed successfully\n", jobName)
+		im.sshClient.ExecuteCommand(fmt.Sprintf("rm %s", tempFile))
+	}
+
+	return nil
+}
+
+// monitoringJobs returns the embedded Nomad job files in deployment order.
+func (im *InstallationManager) monitoringJobs() ([]string, error) {
 	entries, err := im.files.ReadDir("monitoring")
 	if err != nil {
-		return fmt.Errorf("failed to read monitoring directory: %v", err)
+		return nil, fmt.Errorf("failed to read monitoring directory: %v", err)
 	}
 
 	jobOrder := map[string]int{
@@ -50,37 +107,44 @@ func (im *InstallationManager) SetupMonitoring() error {
 		return orderI < orderJ
 	})
 
-	for _, jobName := range orderedJobs {
-		fmt.Printf("Deploying %s...\n", jobName)
-
-		jobContent, err := im.files.ReadFile(filepath.Join("monitoring", jobName))
-		if err != nil {
-			return fmt.Errorf("failed to read job file %s: %v", jobName, err)
-		}
+	return orderedJobs, nil
+}
 
-		modifiedJob := im.modifyServiceName(string(jobContent), machineID)
+// selectedMonitoringJobs narrows monitoringJobs to the jobs listed in the
+// components section, keeping the deployment order.
+func (im *InstallationManager) selectedMonitoringJobs() ([]string, error) {
+	jobs, err := im.monitoringJobs()
+	if err != nil {
+		return nil, err
+	}
 
-		encodedContent := base64.StdEncoding.EncodeToString([]byte(modifiedJob))
-		tempFile := fmt.Sprintf("/tmp/%s", jobName)
+	wanted := im.config.ClusterConfig.Components.MonitoringJobs
+	if len(wanted) == 0 {
+		return jobs, nil
+	}
 
-		createFileCmd := fmt.Sprintf(`echo '%s' | base64 -d > %s`, encodedContent, tempFile)
-		if err := im.sshClient.ExecuteCommand(createFileCmd); err != nil {
-			return fmt.Errorf("failed to create job file: %v", err)
-		}
+	available := make(map[string]bool, len(jobs))
+	for _, jobName := range jobs {
+		available[jobName] = true
+	}
 
-		if err := im.sshClient.ExecuteCommand(fmt.Sprintf("nomad job run %s", tempFile)); err != nil {
-			return fmt.Errorf("failed to run job %s: %v", jobName, err)
+	selected := make(map[string]bool, len(wanted))
+	for _, name := range wanted {
+		jobName := strings.TrimSuffix(name, ".nomad") + ".nomad"
+		if !available[jobName] {
+			return nil, fmt.Errorf("unknown monitoring job %q in components", name)
 		}
+		selected[jobName] = true
+	}
 
-		if err := im.waitForJobHealth(jobName); err != nil {
-			return fmt.Errorf("job %s failed to become healthy: %v", jobName, err)
+	var filtered []string
+	for _, jobName := range jobs {
+		if selected[jobName] {
+			filtered = append(filtered, jobName)
 		}
-
-		fmt.Printf("%s deployed successfully\n", jobName)
-		im.sshClient.ExecuteCommand(fmt.Sprintf("rm %s", tempFile))
 	}
 
-	return nil
+	return filtered, nil
 }
 
 func (im *InstallationManager) modifyServiceName(jobContent string, machineID string) string {
@@ -103,15 +167,15 @@ func (im *InstallationManager) modifyServiceName(jobContent string, machineID st
 	return strings.Join(lines, "\n")
 }
 
-func (im *InstallationManager) waitForNomadCluster() error {
-	maxRetries := 30
-	for i := 0; i < maxRetries; i++ {
-		if err := im.sshClient.ExecuteCommand("nomad status"); err == nil {
-			return nil
-		}
-		time.Sleep(10 * time.Second)
+func (im *InstallationManager) waitForNomadCluster(ctx context.Context, token string) error {
+	policy := waitPolicy(nomadClusterPolicy, im.config.Timeouts.NomadCluster)
+	err := retry.Do(ctx, policy, func(int) error {
+		return im.sshClient.ExecuteCommand(withNomadToken(token, "nomad status"))
+	})
+	if err != nil {
+		return fmt.Errorf("nomad not ready after %d attempts: %v", policy.Attempts, err)
 	}
-	return fmt.Errorf("nomad not ready after %d attempts", maxRetries)
+	return nil
 }
 
 func (im *InstallationManager) getMachineID() (string, error) {
@@ -131,64 +195,49 @@ func (im *InstallationManager) getMachineID() (string, error) {
 	return strings.TrimSpace(string(output)), nil
 }
 
-func (im *InstallationManager) waitForJobHealth(jobName string) error {
+func (im *InstallationManager) waitForJobHealth(ctx context.Context, jobName, token string) error {
 	jobBaseName := strings.TrimSuffix(jobName, ".nomad")
-	retries := 30
+	policy := waitPolicy(jobHealthyPolicy, im.config.Timeouts.JobHealthy)
 
-	for i := 0; i < retries; i++ {
-		output, err := im.sshClient.ExecuteCommandWithOutput(fmt.Sprintf("nomad job status %s", jobBaseName))
+	err := retry.Do(ctx, policy, func(attempt int) error {
+		output, err := im.sshClient.ExecuteCommandWithOutput(withNomadToken(token, fmt.Sprintf("nomad job status %s", jobBaseName)))
 		if err != nil {
-			time.Sleep(10 * time.Second)
-			continue
+			return err
 		}
 
-		if strings.Contains(output, "Status") && strings.Contains(output, "running") {
-			switch jobBaseName {
-			case "loki":
-				if err := im.checkLokiHealth(); err != nil {
-					time.Sleep(10 * time.Second)
-					continue
-				}
-				fmt.Printf("Loki health check passed\n")
-			case "prometheus":
-				if err := im.checkPrometheusHealth(); err != nil {
-					time.Sleep(10 * time.Second)
-					continue
-				}
-				fmt.Printf("Prometheus health check passed\n")
-			}
-			return nil
+		if !strings.Contains(output, "Status") || !strings.Contains(output, "running") {
+			fmt.Printf("Waiting for %s to be ready... (attempt %d/%d)\n", jobBaseName, attempt, policy.Attempts)
+			return fmt.Errorf("job %s is not running", jobBaseName)
 		}
 
-		fmt.Printf("Waiting for %s to be ready... (attempt %d/%d)\n", jobBaseName, i+1, retries)
-		time.Sleep(10 * time.Second)
-	}
-
-	return fmt.Errorf("timeout waiting for job %s to become healthy", jobBaseName)
-}
-
-func (im *InstallationManager) checkLokiHealth() error {
-	retries := 5
-	for i := 0; i < retries; i++ {
-		cmd := `curl -s -f http://localhost:3100/ready`
-		err := im.sshClient.ExecuteCommand(cmd)
-		if err == nil {
-			return nil
+		switch jobBaseName {
+		case "loki":
+			if err := im.checkServiceReady(ctx, "loki", "http://localhost:3100/ready"); err != nil {
+				return err
+			}
+			fmt.Printf("Loki health check passed\n")
+		case "prometheus":
+			if err := im.checkServiceReady(ctx, "prometheus", "http://localhost:9090/-/ready"); err != nil {
+				return err
+			}
+			fmt.Printf("Prometheus health check passed\n")
 		}
-		time.Sleep(5 * time.Second)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("timeout waiting for job %s to become healthy: %v", jobBaseName, err)
 	}
-	return fmt.Errorf("loki health check failed after %d attempts", retries)
+
+	return nil
 }
 
-func (im *InstallationManager) checkPrometheusHealth() error {
-	retries := 5
-	for i := 0; i < retries; i++ {
-		cmd := `curl -s -f http://localhost:9090/-/ready`
-		err := im.sshClient.ExecuteCommand(cmd)
-		if err == nil {
-			return nil
-		}
-		time.Sleep(5 * time.Second)
+func (im *InstallationManager) checkServiceReady(ctx context.Context, name, url string) error {
+	policy := waitPolicy(serviceReadyPolicy, im.config.Timeouts.ServiceReady)
+	err := retry.Do(ctx, policy, func(int) error {
+		return im.sshClient.ExecuteCommand(fmt.Sprintf("curl -s -f %s", url))
+	})
+	if err != nil {
+		return fmt.Errorf("%s health check failed after %d attempts", name, policy.Attempts)
 	}
-	return fmt.Errorf("prometheus health check failed after %d attempts", retries)
+	return nil
 }
@@ -0,0 +1,172 @@
+package manager
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/brimblehq/migration/internal/types"
+)
+
+const (
+	tailscaleIPCommand = "tailscale ip -4"
+	tailscaleInterface = "tailscale0"
+)
+
+// tailscalePlaceholder stands in for a Tailscale address in plans; it is only
+// known once the host has joined the tailnet.
+const tailscalePlaceholder = "<tailscale-ip>"
+
+// networkMode returns the configured network mode, public when unset.
+func (im *InstallationManager) networkMode() (types.NetworkMode, error) {
+	switch mode := im.config.ClusterConfig.NetworkMode; mode {
+	case "":
+		return types.NetworkPublic, nil
+	case types.NetworkPublic, types.NetworkPrivate:
+		return mode, nil
+	case types.NetworkTailscale:
+		if !enabled(im.selectedComponents().Tailscale) {
+			return "", fmt.Errorf("network_mode %q needs the tailscale component on %s", mode, im.server.Host)
+		}
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown network_mode %q, expected %q, %q or %q", mode, types.NetworkPublic, types.NetworkPrivate, types.NetworkTailscale)
+	}
+}
+
+// ClusterAddress returns the address this host binds and advertises for
+// Consul and Nomad, and records it with the server. In tailscale mode it is
+// read from the host, so it is only known after the base packages join it to
+// the tailnet.
+func (im *InstallationManager) ClusterAddress() (string, error) {
+	if im.addr != "" {
+		return im.addr, nil
+	}
+
+	mode, err := im.networkMode()
+	if err != nil {
+		return "", err
+	}
+
+	var addr string
+	switch mode {
+	case types.NetworkPrivate:
+		addr = im.server.PrivateIP
+		if addr == "" {
+			return "", fmt.Errorf("%s has no private_ip for network_mode %q", im.server.Host, mode)
+		}
+	case types.NetworkTailscale:
+		if im.sshClient == nil {
+			return tailscalePlaceholder, nil
+		}
+
+		output, err := im.sshClient.ExecuteCommandWithOutput(tailscaleIPCommand)
+		if err != nil {
+			return "", fmt.Errorf("failed to read the tailscale address of %s, has it joined the tailnet? %v", im.server.Host, err)
+		}
+		addr = strings.TrimSpace(strings.SplitN(strings.TrimSpace(output), "\n", 2)[0])
+		if net.ParseIP(addr) == nil {
+			return "", fmt.Errorf("%s reported %q as its tailscale address", im.server.Host, addr)
+		}
+	default:
+		addr = im.server.PublicIP
+	}
+
+	if im.sshClient != nil && im.DB != nil {
+		machineID, err := im.getMachineID()
+		if err != nil {
+			return "", fmt.Errorf("failed to get machine-id: %v", err)
+		}
+		if err := im.DB.UpdateServerAddress(machineID, addr); err != nil {
+			return "", err
+		}
+	}
+
+	im.addr = addr
+	return addr, nil
+}
+
+// firewallScope limits the cluster ports to the other members: the tailscale
+// interface in tailscale mode, otherwise the members' private or public
+// addresses. Nothing is opened to any source, 4646 included.
+func (im *InstallationManager) firewallScope() (firewallScope, error) {
+	mode, err := im.networkMode()
+	if err != nil {
+		return firewallScope{}, err
+	}
+
+	if mode == types.NetworkTailscale {
+		return firewallScope{iface: tailscaleInterface}, nil
+	}
+
+	var scope firewallScope
+	for _, server := range im.config.Servers {
+		addr := server.PublicIP
+		if mode == types.NetworkPrivate {
+			addr = server.PrivateIP
+		}
+		if addr != "" && !contains(scope.sources, addr) {
+			scope.sources = append(scope.sources, addr)
+		}
+	}
+
+	return scope, nil
+}
+
+// getNomadServerAddresses returns the RPC address of every Nomad server in the
+// cluster. In tailscale mode the addresses come from the server records, so a
+// server that has not reached the Consul step yet is left out; Consul
+// auto-join still finds it.
+func (im *InstallationManager) getNomadServerAddresses() ([]string, error) {
+	mode, err := im.networkMode()
+	if err != nil {
+		return nil, err
+	}
+
+	recorded := make(map[string]string)
+	if mode == types.NetworkTailscale && im.DB != nil {
+		states, err := im.DB.GetAllServers()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get server addresses: %v", err)
+		}
+		for _, state := range states {
+			recorded[state.PrivateIP] = state.Address
+		}
+	}
+
+	var servers, missing []string
+	for _, server := range im.cluster.Servers {
+		var addr string
+		switch {
+		case server.PrivateIP == im.server.PrivateIP:
+			if addr, err = im.ClusterAddress(); err != nil {
+				return nil, err
+			}
+		case mode == types.NetworkPrivate:
+			addr = server.PrivateIP
+		case mode == types.NetworkTailscale:
+			addr = recorded[server.PrivateIP]
+			if addr == "" && im.sshClient == nil {
+				addr = tailscalePlaceholder
+			}
+		default:
+			addr = server.PublicIP
+		}
+
+		if addr == "" {
+			missing = append(missing, server.Host)
+			continue
+		}
+		servers = append(servers, fmt.Sprintf("%s:%d", addr, nomadRPCPort))
+	}
+
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no Nomad server has recorded a %s address yet", mode)
+	}
+	if len(missing) > 0 {
+		log.Printf("Note: leaving %s out of the Nomad server list until their %s address is recorded", strings.Join(missing, ", "), mode)
+	}
+
+	return servers, nil
+}
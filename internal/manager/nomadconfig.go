@@ -0,0 +1,386 @@
+package manager
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/brimblehq/migration/internal/types"
+)
+
+const (
+	nomadHTTPPort = 4646
+	nomadRPCPort  = 4647
+	nomadSerfPort = 4648
+)
+
+func defaultNomadPlugins() map[string]interface{} {
+	return map[string]interface{}{
+		"docker": map[string]interface{}{
+			"config": map[string]interface{}{
+				"allow_privileged": true,
+				"volumes": map[string]interface{}{
+					"enabled": true,
+				},
+			},
+		},
+	}
+}
+
+// nomadModel builds this host's agent configuration from its roles, its
+// cluster address and the Nomad servers' RPC addresses, with the cluster's and
+// then the server's nomad options layered on top.
+func (im *InstallationManager) nomadModel(nodeName, addr string, servers []string) types.NomadConfig {
+	cfg := types.NomadConfig{
+		DataCenter: im.config.ClusterConfig.ConsulConfig.DataCenter,
+		DataDir:    "/opt/nomad/data",
+		LogLevel:   "INFO",
+		BindAddr:   addr,
+		// HTTP listens on loopback, so the nomad CLI and the health checks
+		// work from the host itself, and on the cluster address only.
+		Addresses: types.AdvertiseAddrs{HTTP: strings.TrimSpace("127.0.0.1 " + addr)},
+		AdvertiseAddrs: types.AdvertiseAddrs{
+			HTTP: fmt.Sprintf("%s:%d", addr, nomadHTTPPort),
+			RPC:  fmt.Sprintf("%s:%d", addr, nomadRPCPort),
+			Serf: fmt.Sprintf("%s:%d", addr, nomadSerfPort),
+		},
+		ConsulConfig: types.NomadConsulConfig{
+			Address:           "127.0.0.1:8500",
+			Token:             im.config.ClusterConfig.ConsulConfig.Token,
+			ClientServiceName: nodeName,
+		},
+		ACLEnabled: im.aclEnabled(),
+		Plugins:    defaultNomadPlugins(),
+		Telemetry: types.TelemetryConfig{
+			CollectionInterval:       "1s",
+			DisableHostname:          true,
+			PrometheusMetrics:        true,
+			PublishAllocationMetrics: true,
+			PublishNodeMetrics:       true,
+		},
+	}
+
+	if im.IsServer() {
+		cfg.ServerConfig = &types.ServerConfig{
+			Enabled:         true,
+			BootstrapExpect: im.getServerCount(),
+		}
+	}
+
+	if HasRole(im.roles, types.RoleClient) {
+		cfg.ClientConfig = &types.ClientConfig{
+			Enabled: true,
+			Servers: servers,
+		}
+	}
+
+	applyNomadOptions(&cfg, im.config.ClusterConfig.Nomad)
+	if im.server.Nomad != nil {
+		applyNomadOptions(&cfg, *im.server.Nomad)
+	}
+
+	return cfg
+}
+
+// applyNomadOptions layers options onto cfg. Meta, host volumes and limits
+// replace entries with the same key; plugins are merged key by key.
+func applyNomadOptions(cfg *types.NomadConfig, options types.NomadOptions) {
+	if client := cfg.ClientConfig; client != nil {
+		for key, value := range options.ClientMeta {
+			if client.Meta == nil {
+				client.Meta = make(map[string]string)
+			}
+			client.Meta[key] = value
+		}
+		for name, volume := range options.HostVolumes {
+			if client.HostVolumes == nil {
+				client.HostVolumes = make(map[string]types.HostVolume)
+			}
+			client.HostVolumes[name] = volume
+		}
+	}
+
+	if len(options.Plugins) > 0 {
+		cfg.Plugins = mergeValues(cfg.Plugins, options.Plugins)
+	}
+	if len(options.Limits) > 0 {
+		cfg.Limits = mergeValues(cfg.Limits, options.Limits)
+	}
+}
+
+// mergeValues returns base with override merged over it, recursing into
+// nested maps.
+func mergeValues(base, override map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(override))
+	for key, value := range base {
+		merged[key] = value
+	}
+
+	for key, value := range override {
+		from, fromMap := value.(map[string]interface{})
+		to, toMap := merged[key].(map[string]interface{})
+		if fromMap && toMap {
+			merged[key] = mergeValues(to, from)
+			continue
+		}
+		merged[key] = value
+	}
+
+	return merged
+}
+
+// nomadConfig builds and renders the nomad.hcl for this host.
+func (im *InstallationManager) nomadConfig(nodeName string) (types.NomadConfig, string, error) {
+	addr, err := im.ClusterAddress()
+	if err != nil {
+		return types.NomadConfig{}, "", err
+	}
+
+	var servers []string
+	if HasRole(im.roles, types.RoleClient) {
+		if servers, err = im.getNomadServerAddresses(); err != nil {
+			return types.NomadConfig{}, "", err
+		}
+	}
+
+	model := im.nomadModel(nodeName, addr, servers)
+	rendered, err := renderNomadConfig(model)
+	return model, rendered, err
+}
+
+// hostVolumeCommands creates the directories behind the client's host volumes,
+// which Nomad expects to exist when the client starts.
+func hostVolumeCommands(cfg types.NomadConfig) []string {
+	if cfg.ClientConfig == nil {
+		return nil
+	}
+
+	var commands []string
+	for _, name := range sortedKeys(cfg.ClientConfig.HostVolumes) {
+		if path := cfg.ClientConfig.HostVolumes[name].Path; path != "" {
+			commands = append(commands, fmt.Sprintf("sudo mkdir -p %q", path))
+		}
+	}
+	return commands
+}
+
+// renderNomadConfig writes cfg out as HCL. Stanzas are written in a fixed
+// order and map keys are sorted, so the same model always renders the same
+// file.
+func renderNomadConfig(cfg types.NomadConfig) (string, error) {
+	w := &hclWriter{}
+
+	w.optional("datacenter", cfg.DataCenter)
+	w.optional("data_dir", cfg.DataDir)
+	w.optional("log_level", cfg.LogLevel)
+	w.optional("bind_addr", cfg.BindAddr)
+
+	w.addrs("addresses", cfg.Addresses)
+	w.addrs("advertise", cfg.AdvertiseAddrs)
+
+	if server := cfg.ServerConfig; server != nil {
+		w.block("server", func() {
+			w.attr("enabled", server.Enabled)
+			if server.BootstrapExpect > 0 {
+				w.attr("bootstrap_expect", server.BootstrapExpect)
+			}
+		})
+	}
+
+	if client := cfg.ClientConfig; client != nil {
+		w.block("client", func() {
+			w.attr("enabled", client.Enabled)
+			w.attr("servers", client.Servers)
+
+			if len(client.Meta) > 0 {
+				w.block("meta", func() {
+					for _, key := range sortedKeys(client.Meta) {
+						w.attr(key, client.Meta[key])
+					}
+				})
+			}
+
+			for _, name := range sortedKeys(client.HostVolumes) {
+				volume := client.HostVolumes[name]
+				if volume.Path == "" {
+					w.fail(fmt.Errorf("host volume %q has no path", name))
+				}
+				w.block(fmt.Sprintf("host_volume %s", hclString(name)), func() {
+					w.attr("path", volume.Path)
+					w.attr("read_only", volume.ReadOnly)
+				})
+			}
+		})
+	}
+
+	w.block("consul", func() {
+		w.attr("address", cfg.ConsulConfig.Address)
+		w.attr("token", cfg.ConsulConfig.Token)
+		w.optional("client_service_name", cfg.ConsulConfig.ClientServiceName)
+		w.attr("auto_advertise", true)
+		w.attr("server_auto_join", true)
+		w.attr("client_auto_join", true)
+	})
+
+	if cfg.ACLEnabled {
+		w.block("acl", func() {
+			w.attr("enabled", true)
+		})
+	}
+
+	for _, name := range sortedKeys(cfg.Plugins) {
+		body, ok := cfg.Plugins[name].(map[string]interface{})
+		if !ok {
+			w.fail(fmt.Errorf("plugin %q must be an object", name))
+			continue
+		}
+		w.block(fmt.Sprintf("plugin %s", hclString(name)), func() {
+			w.body(body)
+		})
+	}
+
+	if len(cfg.Limits) > 0 {
+		w.block("limits", func() {
+			w.body(cfg.Limits)
+		})
+	}
+
+	w.block("telemetry", func() {
+		w.attr("collection_interval", cfg.Telemetry.CollectionInterval)
+		w.attr("disable_hostname", cfg.Telemetry.DisableHostname)
+		w.attr("prometheus_metrics", cfg.Telemetry.PrometheusMetrics)
+		w.attr("publish_allocation_metrics", cfg.Telemetry.PublishAllocationMetrics)
+		w.attr("publish_node_metrics", cfg.Telemetry.PublishNodeMetrics)
+	})
+
+	if w.err != nil {
+		return "", fmt.Errorf("failed to render nomad config: %v", w.err)
+	}
+	return w.b.String(), nil
+}
+
+var hclIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// hclWriter writes indented HCL. The first error is kept in err and later
+// writes carry on, so a document is rendered in one pass and checked once.
+type hclWriter struct {
+	b     strings.Builder
+	depth int
+	err   error
+}
+
+func (w *hclWriter) fail(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *hclWriter) line(text string) {
+	w.b.WriteString(strings.Repeat("\t", w.depth))
+	w.b.WriteString(text)
+	w.b.WriteString("\n")
+}
+
+// block writes header { ... } with the attributes and blocks written by fn.
+// Top-level blocks are separated by a blank line.
+func (w *hclWriter) block(header string, fn func()) {
+	if w.depth == 0 && w.b.Len() > 0 {
+		w.b.WriteString("\n")
+	}
+	w.line(header + " {")
+	w.depth++
+	fn()
+	w.depth--
+	w.line("}")
+}
+
+func (w *hclWriter) attr(key string, value interface{}) {
+	if !hclIdentifier.MatchString(key) {
+		key = hclString(key)
+	}
+	w.line(fmt.Sprintf("%s = %s", key, w.value(value)))
+}
+
+func (w *hclWriter) optional(key, value string) {
+	if value != "" {
+		w.attr(key, value)
+	}
+}
+
+func (w *hclWriter) addrs(name string, addrs types.AdvertiseAddrs) {
+	if addrs == (types.AdvertiseAddrs{}) {
+		return
+	}
+	w.block(name, func() {
+		w.optional("http", addrs.HTTP)
+		w.optional("rpc", addrs.RPC)
+		w.optional("serf", addrs.Serf)
+	})
+}
+
+// body writes a map decoded from the config: attributes first, then nested
+// maps as blocks, each in key order.
+func (w *hclWriter) body(values map[string]interface{}) {
+	var blocks []string
+	for _, key := range sortedKeys(values) {
+		if _, ok := values[key].(map[string]interface{}); ok {
+			blocks = append(blocks, key)
+			continue
+		}
+		w.attr(key, values[key])
+	}
+
+	for _, key := range blocks {
+		if !hclIdentifier.MatchString(key) {
+			w.fail(fmt.Errorf("%q is not a valid block name", key))
+			continue
+		}
+		nested := values[key].(map[string]interface{})
+		w.block(key, func() {
+			w.body(nested)
+		})
+	}
+}
+
+func (w *hclWriter) value(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return hclString(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []string:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = hclString(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = w.value(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	default:
+		w.fail(fmt.Errorf("unsupported value %v (%T)", value, value))
+		return `""`
+	}
+}
+
+func hclString(s string) string {
+	return strconv.Quote(s)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,124 @@
+package manager
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/brimblehq/migration/internal/types"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func testManager(roles []types.ClusterRole, serverNodes int, cluster types.ClusterConfig, server types.Server) *InstallationManager {
+	cluster.ConsulConfig = types.ConsulConfig{DataCenter: "dc1", Token: "consul-token"}
+	server.PublicIP = "203.0.113.10"
+
+	return &InstallationManager{
+		server:  server,
+		roles:   roles,
+		config:  &types.Config{ClusterConfig: cluster},
+		cluster: &ClusterManager{ServerNodes: serverNodes},
+	}
+}
+
+func TestRenderNomadConfig(t *testing.T) {
+	both := []types.ClusterRole{types.RoleServer, types.RoleClient}
+	servers := []string{"203.0.113.10:4647", "203.0.113.11:4647", "203.0.113.12:4647"}
+
+	tests := []struct {
+		name    string
+		im      *InstallationManager
+		servers []string
+	}{
+		{
+			name:    "single_node",
+			im:      testManager(both, 1, types.ClusterConfig{}, types.Server{}),
+			servers: servers[:1],
+		},
+		{
+			name:    "server_client",
+			im:      testManager(both, 3, types.ClusterConfig{}, types.Server{}),
+			servers: servers,
+		},
+		{
+			name:    "client_only",
+			im:      testManager([]types.ClusterRole{types.RoleClient}, 3, types.ClusterConfig{}, types.Server{}),
+			servers: servers,
+		},
+		{
+			name:    "acl",
+			im:      testManager(both, 3, types.ClusterConfig{ACL: true}, types.Server{}),
+			servers: servers,
+		},
+		{
+			name: "user_stanzas",
+			im: testManager([]types.ClusterRole{types.RoleClient}, 3, types.ClusterConfig{
+				Nomad: types.NomadOptions{
+					ClientMeta: map[string]string{"tier": "builder", "node.pool": "edge"},
+					HostVolumes: map[string]types.HostVolume{
+						"cache": {Path: "/srv/cache"},
+						"certs": {Path: "/etc/ssl/certs", ReadOnly: true},
+					},
+					Plugins: map[string]interface{}{
+						"docker": map[string]interface{}{
+							"config": map[string]interface{}{
+								"allow_caps": []interface{}{"audit_write", "chown"},
+							},
+						},
+						"raw_exec": map[string]interface{}{
+							"config": map[string]interface{}{"enabled": true},
+						},
+					},
+					Limits: map[string]interface{}{"http_max_conns_per_client": float64(200)},
+				},
+			}, types.Server{
+				Nomad: &types.NomadOptions{ClientMeta: map[string]string{"tier": "gpu"}},
+			}),
+			servers: servers,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderNomadConfig(tt.im.nomadModel("nomad-client-0123456789", "203.0.113.10", tt.servers))
+			if err != nil {
+				t.Fatalf("renderNomadConfig: %v", err)
+			}
+
+			golden := filepath.Join("testdata", "nomad", tt.name+".hcl")
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("reading golden file: %v", err)
+			}
+			if got != string(want) {
+				t.Errorf("rendered config differs from %s:\n--- got ---\n%s\n--- want ---\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+func TestRenderNomadConfigRejectsInvalidStanzas(t *testing.T) {
+	tests := map[string]types.NomadOptions{
+		"host volume without path":     {HostVolumes: map[string]types.HostVolume{"data": {}}},
+		"plugin that is not an object": {Plugins: map[string]interface{}{"docker": true}},
+		"invalid block name":           {Limits: map[string]interface{}{"bad name": map[string]interface{}{"x": true}}},
+		"nested object in a list":      {Limits: map[string]interface{}{"list": []interface{}{map[string]interface{}{}}}},
+	}
+
+	for name, options := range tests {
+		t.Run(name, func(t *testing.T) {
+			im := testManager([]types.ClusterRole{types.RoleClient}, 1, types.ClusterConfig{Nomad: options}, types.Server{})
+			if _, err := renderNomadConfig(im.nomadModel("node", "203.0.113.10", nil)); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
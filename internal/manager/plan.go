@@ -0,0 +1,246 @@
+package manager
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/brimblehq/migration/internal/types"
+)
+
+// The Plan methods mirror the provisioning steps but only describe what would run
+// on the host. Lines starting with "#" are notes about conditional or polled
+// commands rather than commands themselves. Nothing here touches the SSH client.
+
+const redacted = "<redacted>"
+
+func (im *InstallationManager) PlanVerifyMachineRequirement() []string {
+	return append([]string{osReleaseCommand, archCommand}, requirementCommands...)
+}
+
+// planHostOS is the host's OS family, as InspectHost found it, or Debian/Ubuntu
+// when the host could not be inspected.
+func (im *InstallationManager) planHostOS() osFamily {
+	host, err := im.hostOS()
+	if err != nil {
+		host = debianFamily
+		host.codename = "<codename>"
+	}
+	return host
+}
+
+func (im *InstallationManager) PlanBasePackages() []string {
+	host := im.planHostOS()
+
+	arch, err := im.Architecture()
+	if err != nil {
+		arch = "amd64"
+	}
+
+	note := fmt.Sprintf("# commands for %s on %s, as detected on the host", host.pretty, arch)
+	if im.os == nil {
+		note = fmt.Sprintf("# commands for %s on %s; the host could not be inspected, its OS and architecture are detected when the step runs", host.pretty, arch)
+	}
+	commands := []string{note}
+
+	var components []component
+	if im.config.Bundle != "" {
+		manifest, err := im.hostBundle(host, arch)
+		if err != nil {
+			return append(commands, fmt.Sprintf("# cannot use the offline bundle: %v", err))
+		}
+
+		commands = append(commands,
+			fmt.Sprintf("# upload %s to %s unless bundle %s is already unpacked in %s", manifest.path, bundleUpload, manifest.ID, bundleDir),
+		)
+		commands = append(commands, unpackBundleCommands()...)
+		components = im.bundleComponents(host, manifest)
+	} else {
+		fetch := im.fetcher()
+		components = im.baseComponents(host, arch, fetch)
+		if fetch.err != nil {
+			return append(commands, fmt.Sprintf("# cannot verify downloads: %v", fetch.err))
+		}
+		if !fetch.verified() {
+			commands = append(commands, "# "+unverifiedNote)
+		}
+	}
+
+	for _, c := range components {
+		if c.disabled {
+			commands = append(commands, fmt.Sprintf("# %s: disabled in components", c.name))
+			continue
+		}
+
+		if c.version != "" {
+			commands = append(commands, fmt.Sprintf("# %s: skipped if `%s` reports %s", c.name, c.probe, c.version))
+		} else {
+			commands = append(commands, fmt.Sprintf("# %s: skipped if `%s` succeeds", c.name, c.probe))
+		}
+		for _, file := range c.files {
+			commands = append(commands, fmt.Sprintf("# write %s:\n%s", file.path, strings.TrimSuffix(file.content, "\n")))
+		}
+		commands = append(commands, c.commands...)
+	}
+	return im.redactAll(commands)
+}
+
+func (im *InstallationManager) PlanConsulClient(machineID string) ([]string, error) {
+	addr, err := im.ClusterAddress()
+	if err != nil {
+		return nil, err
+	}
+	scope, err := im.firewallScope()
+	if err != nil {
+		return nil, err
+	}
+
+	var commands []string
+	if mode, _ := im.networkMode(); mode == types.NetworkTailscale {
+		commands = append(commands, tailscaleIPCommand)
+	}
+
+	commands = append(commands,
+		"docker ps -a --format '{{.Names}}' | grep -w consul-client || true",
+		"# if consul-client exists:",
+		"docker stop consul-client",
+		"docker rm consul-client",
+		im.planHostOS().openPorts(scope, consulPorts...),
+		im.consulRunCommand(machineNodeName(machineID), addr),
+		pollNote(waitPolicy(consulReadyPolicy, im.config.Timeouts.ConsulReady)),
+		consulLeaderCmd,
+		consulVersionCmd,
+	)
+	return im.redactAll(commands), nil
+}
+
+func (im *InstallationManager) PlanNomad() []string {
+	commands := []string{
+		"systemctl is-active nomad || true",
+		"# if nomad is active:",
+		im.planWithToken("management", "nomad job stop -purge -yes -detach '*'"),
+		"sudo systemctl stop nomad",
+		"sudo pkill -9 nomad || true",
+	}
+	commands = append(commands, nomadStateCleanupCommands...)
+	scope, _ := im.firewallScope()
+	commands = append(commands,
+		im.planHostOS().openPorts(scope, nomadPorts...),
+		"sudo mkdir -p /etc/nomad.d",
+	)
+	commands = append(commands, hostVolumeCommands(im.nomadModel("", "", nil))...)
+	commands = append(commands,
+		"# write /etc/nomad.d/nomad.hcl (rendered below)",
+		"systemctl is-enabled nomad || true",
+		"sudo systemctl daemon-reload",
+		"# if nomad is already enabled:",
+		"sudo systemctl restart nomad",
+		"# otherwise:",
+		"sudo systemctl enable nomad",
+		"sudo systemctl start nomad",
+		pollNote(waitPolicy(nomadHealthyPolicy, im.config.Timeouts.NomadHealthy)),
+		"systemctl is-active nomad",
+		"curl -s http://127.0.0.1:4646/v1/agent/health",
+	)
+
+	if im.IsServer() {
+		if im.aclEnabled() {
+			commands = append(commands, "# if a management token is stored:")
+		}
+		commands = append(commands, im.planWithToken("management", "nomad server members"))
+	}
+
+	return commands
+}
+
+func (im *InstallationManager) PlanMonitoring() ([]string, error) {
+	jobs, err := im.selectedMonitoringJobs()
+	if err != nil {
+		return nil, err
+	}
+
+	var commands []string
+	if im.aclEnabled() {
+		commands = append(commands,
+			"# while waiting for the cluster, once the servers elect a leader, check a stored management token:",
+			im.planWithToken("management", nomadTokenSelfCmd),
+			"# if none is stored, or the cluster rejects it (stored tokens are dropped):",
+			nomadBootstrapCmd,
+		)
+		for _, policy := range nomadPolicies {
+			commands = append(commands, fmt.Sprintf("# create policy %s and a client token for it, stored encrypted in the state database", policy.name))
+		}
+		commands = append(commands, tokenFileNote("monitoring"))
+	}
+
+	commands = append(commands,
+		pollNote(waitPolicy(nomadClusterPolicy, im.config.Timeouts.NomadCluster)),
+		im.planWithToken("monitoring", "nomad status"),
+	)
+
+	for _, jobName := range jobs {
+		jobContent, err := im.files.ReadFile(filepath.Join("monitoring", jobName))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read job file %s: %v", jobName, err)
+		}
+		if im.config.Bundle == "" {
+			for _, image := range jobImages(string(jobContent)) {
+				commands = append(commands, fmt.Sprintf("%s # must list every cluster architecture", manifestCommand(image)))
+			}
+		}
+
+		tempFile := fmt.Sprintf("/tmp/%s", jobName)
+		commands = append(commands,
+			fmt.Sprintf("# write %s from embedded monitoring/%s", tempFile, jobName),
+			im.planWithToken("monitoring", fmt.Sprintf("nomad job run %s", tempFile)),
+			im.planWithToken("monitoring", fmt.Sprintf("nomad job status %s", strings.TrimSuffix(jobName, ".nomad"))),
+			fmt.Sprintf("rm %s", tempFile),
+		)
+	}
+
+	return commands, nil
+}
+
+func (im *InstallationManager) PlanRunner(licenseToken string, instances string) ([]string, error) {
+	command, err := runnerCommand(licenseToken, instances)
+	if err != nil {
+		return nil, err
+	}
+
+	var commands []string
+	if im.aclEnabled() {
+		commands = append(commands, tokenFileNote("runner"))
+	}
+	return append(commands, im.planWithToken("runner", redact(command, licenseToken))), nil
+}
+
+// NomadConfig returns the nomad.hcl this host would receive, with secrets redacted.
+func (im *InstallationManager) NomadConfig(machineID string) (string, error) {
+	_, nomadConfig, err := im.nomadConfig(machineNodeName(machineID))
+	if err != nil {
+		return "", err
+	}
+	return im.redact(nomadConfig), nil
+}
+
+func (im *InstallationManager) redact(text string) string {
+	return redact(text, im.tailScaleToken, im.config.ClusterConfig.ConsulConfig.Token)
+}
+
+func (im *InstallationManager) redactAll(commands []string) []string {
+	redactedCommands := make([]string, len(commands))
+	for i, cmd := range commands {
+		redactedCommands[i] = im.redact(cmd)
+	}
+	return redactedCommands
+}
+
+func redact(text string, secrets ...string) string {
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		text = strings.ReplaceAll(text, secret, redacted)
+	}
+	return text
+}
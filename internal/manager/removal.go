@@ -0,0 +1,143 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/brimblehq/migration/internal/retry"
+)
+
+// DrainNode marks the local Nomad client ineligible, migrates its allocations
+// away and waits until none are left running on it.
+func (im *InstallationManager) DrainNode(ctx context.Context) error {
+	token, err := im.managementToken()
+	if err != nil {
+		return err
+	}
+
+	drainCmd := "nomad node drain -self -enable -yes -deadline 10m -m 'brimble remove-node'"
+	if err := im.sshClient.ExecuteCommand(withNomadToken(token, drainCmd)); err != nil {
+		return fmt.Errorf("failed to drain node: %v", err)
+	}
+
+	nodeID, err := im.sshClient.ExecuteCommandWithOutput(withNomadToken(token, "nomad node status -self -t '{{.ID}}'"))
+	if err != nil {
+		return fmt.Errorf("failed to get nomad node id: %v", err)
+	}
+
+	allocsCmd := withNomadToken(token, fmt.Sprintf(`nomad operator api /v1/node/%s/allocations | grep -o '"ClientStatus":"running"' | wc -l`, strings.TrimSpace(nodeID)))
+
+	policy := waitPolicy(nodeDrainPolicy, im.config.Timeouts.NodeDrain)
+	err = retry.Do(ctx, policy, func(attempt int) error {
+		output, err := im.sshClient.ExecuteCommandWithOutput(allocsCmd)
+		if err != nil {
+			return err
+		}
+		if running, _ := strconv.Atoi(strings.TrimSpace(output)); running > 0 {
+			fmt.Printf("Waiting for %d allocation(s) to migrate... (attempt %d/%d)\n", running, attempt, policy.Attempts)
+			return fmt.Errorf("%d allocation(s) still running", running)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("allocations still running after %d attempts: %v", policy.Attempts, err)
+	}
+
+	return nil
+}
+
+// CheckRaftRemoval verifies, from a server that stays in the cluster, that the
+// server advertising on address can leave without costing quorum: it must be a
+// Raft peer but not the only one, and every current server must be alive.
+// force skips the liveness check and lets a server missing from the peer set,
+// such as one whose recorded address is stale, go with a warning.
+func (im *InstallationManager) CheckRaftRemoval(address string, force bool) error {
+	peers, err := im.raftPeers()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := peers[address]; !ok {
+		if !force {
+			return fmt.Errorf("refusing to remove %s: it is not in the Raft peer set (%s), check the address recorded for it or pass --force", address, strings.Join(sortedKeys(peers), ", "))
+		}
+		log.Printf("Warning: %s is not in the Raft peer set (%s), its peer will not be removed", address, strings.Join(sortedKeys(peers), ", "))
+		return nil
+	}
+
+	if len(peers) <= 1 {
+		return fmt.Errorf("refusing to remove %s: it is the only Nomad server", address)
+	}
+
+	token, err := im.managementToken()
+	if err != nil {
+		return err
+	}
+
+	members, err := im.sshClient.ExecuteCommandWithOutput(withNomadToken(token, "nomad server members | grep -c alive || true"))
+	if err != nil {
+		return fmt.Errorf("failed to list server members: %v", err)
+	}
+	alive, _ := strconv.Atoi(strings.TrimSpace(members))
+
+	if alive < len(peers) && !force {
+		return fmt.Errorf("refusing to remove %s: only %d of %d servers are alive, removing a peer could lose quorum", address, alive, len(peers))
+	}
+
+	return nil
+}
+
+// RemoveRaftPeer removes the server advertising on address from the Raft peer
+// set. It must run on a server that stays in the cluster, after
+// CheckRaftRemoval; a peer that is already gone only warns.
+func (im *InstallationManager) RemoveRaftPeer(address string) error {
+	peers, err := im.raftPeers()
+	if err != nil {
+		return err
+	}
+
+	peerID, ok := peers[address]
+	if !ok {
+		log.Printf("Warning: %s is not in the Raft peer set, nothing to remove", address)
+		return nil
+	}
+
+	token, err := im.managementToken()
+	if err != nil {
+		return err
+	}
+
+	removeCmd := fmt.Sprintf("nomad operator raft remove-peer -peer-id=%s", peerID)
+	if err := im.sshClient.ExecuteCommand(withNomadToken(token, removeCmd)); err != nil {
+		return fmt.Errorf("failed to remove raft peer: %v", err)
+	}
+
+	return nil
+}
+
+// raftPeers maps each Raft peer's address to its ID.
+func (im *InstallationManager) raftPeers() (map[string]string, error) {
+	token, err := im.managementToken()
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := im.sshClient.ExecuteCommandWithOutput(withNomadToken(token, "nomad operator raft list-peers"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list raft peers: %v", err)
+	}
+
+	peers := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		peers[fields[2]] = fields[1]
+	}
+
+	return peers, nil
+}
@@ -0,0 +1,32 @@
+package manager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/brimblehq/migration/internal/retry"
+	"github.com/brimblehq/migration/internal/types"
+)
+
+// Built-in wait loops. The timeouts section of the config overrides any field.
+var (
+	consulReadyPolicy  = retry.Fixed(30, 2*time.Second)
+	nomadHealthyPolicy = retry.Fixed(20, 2*time.Second)
+	nomadClusterPolicy = retry.Fixed(30, 10*time.Second)
+	nomadLeaderPolicy  = retry.Fixed(30, 5*time.Second)
+	jobHealthyPolicy   = retry.Fixed(30, 10*time.Second)
+	serviceReadyPolicy = retry.Fixed(5, 5*time.Second)
+	nodeDrainPolicy    = retry.Fixed(30, 10*time.Second)
+)
+
+func waitPolicy(fallback retry.Policy, configured types.RetryPolicy) retry.Policy {
+	return fallback.Merge(retry.FromConfig(configured))
+}
+
+// pollNote describes a wait loop in plan output.
+func pollNote(policy retry.Policy) string {
+	if policy.Backoff > 1 {
+		return fmt.Sprintf("# poll up to %d times, from every %s with backoff:", policy.Attempts, policy.Interval)
+	}
+	return fmt.Sprintf("# poll up to %d times, every %s:", policy.Attempts, policy.Interval)
+}
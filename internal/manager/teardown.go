@@ -0,0 +1,120 @@
+package manager
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The teardown methods reverse the provisioning steps. Each one is safe to run
+// against a host where the matching step never completed.
+
+func (im *InstallationManager) StopRunner() error {
+	return im.runAll([]string{
+		"sudo pkill -x runner || true",
+	})
+}
+
+func (im *InstallationManager) PurgeMonitoring() error {
+	jobs, err := im.monitoringJobs()
+	if err != nil {
+		return err
+	}
+
+	token, err := im.managementToken()
+	if err != nil {
+		return err
+	}
+
+	var commands []string
+	for _, jobName := range jobs {
+		commands = append(commands, withNomadToken(token, fmt.Sprintf("nomad job stop -purge -yes %s || true", strings.TrimSuffix(jobName, ".nomad"))))
+	}
+
+	return im.runAll(commands)
+}
+
+func (im *InstallationManager) StopNomad() error {
+	status, err := im.sshClient.ExecuteCommandWithOutput("systemctl is-active nomad || true")
+	if err != nil {
+		return fmt.Errorf("failed to check nomad status: %v", err)
+	}
+
+	token, err := im.managementToken()
+	if err != nil {
+		return err
+	}
+
+	var commands []string
+	if strings.TrimSpace(status) == "active" {
+		commands = append(commands,
+			withNomadToken(token, "nomad node drain -self -enable -yes -deadline 5m || true"),
+			"sudo systemctl stop nomad",
+		)
+	}
+
+	commands = append(commands,
+		"sudo systemctl disable nomad || true",
+		"sudo pkill -9 nomad || true",
+		"for m in $(mount | grep nomad | awk '{print $3}'); do sudo umount $m || true; done",
+		"sudo rm -rf /opt/nomad/data",
+		"sudo rm -f /etc/nomad.d/nomad.hcl",
+		"rm -f "+nomadTokenFiles,
+	)
+
+	return im.runAll(commands)
+}
+
+func (im *InstallationManager) RemoveConsulClient() error {
+	return im.runAll([]string{
+		"docker exec consul-client consul leave 2>/dev/null || true",
+		"docker rm -f consul-client 2>/dev/null || true",
+	})
+}
+
+func (im *InstallationManager) LeaveTailnet() error {
+	return im.runAll([]string{
+		"command -v tailscale >/dev/null && sudo tailscale logout || true",
+	})
+}
+
+func (im *InstallationManager) UninstallPackages() error {
+	host, err := im.hostOS()
+	if err != nil {
+		return err
+	}
+
+	commands := []string{
+		"sudo rm -f /usr/local/bin/runner",
+		"sudo rm -rf /opt/cni/bin",
+		host.remove("nomad", "consul-cni", "infisical", host.redisPackage, "nodejs"),
+		host.remove("docker-ce", "docker-ce-cli", "containerd.io", "docker-buildx-plugin", "docker-compose-plugin", "docker-compose", "docker"),
+		host.remove("tailscale"),
+		// Tailscale installed from its static release has no package.
+		"sudo systemctl disable --now tailscaled 2>/dev/null || true",
+		"sudo rm -f /usr/bin/tailscale /usr/sbin/tailscaled /etc/systemd/system/tailscaled.service /etc/default/tailscaled",
+		"sudo rm -f /usr/local/lib/docker/cli-plugins/docker-compose",
+	}
+
+	if host.debian() {
+		return im.runAll(append(commands,
+			"sudo rm -f /etc/apt/sources.list.d/hashicorp.list /usr/share/keyrings/hashicorp-archive-keyring.gpg",
+			"sudo rm -f /etc/apt/sources.list.d/docker.list /etc/apt/keyrings/docker.asc",
+			"sudo rm -f /etc/apt/sources.list.d/nodesource.list /etc/apt/keyrings/nodesource.gpg",
+			"sudo apt-get autoremove -y",
+		))
+	}
+
+	return im.runAll(append(commands,
+		"sudo rm -f /etc/yum.repos.d/hashicorp.repo /etc/yum.repos.d/docker-ce.repo /etc/yum.repos.d/nodesource-nodejs.repo",
+		fmt.Sprintf("sudo %s autoremove -y", host.pkg),
+	))
+}
+
+func (im *InstallationManager) runAll(commands []string) error {
+	for _, cmd := range commands {
+		if err := im.sshClient.ExecuteCommand(cmd); err != nil {
+			return fmt.Errorf("failed to execute command %q: %v", cmd, err)
+		}
+	}
+	return nil
+}
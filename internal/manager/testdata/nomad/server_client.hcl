@@ -0,0 +1,50 @@
+datacenter = "dc1"
+data_dir = "/opt/nomad/data"
+log_level = "INFO"
+bind_addr = "203.0.113.10"
+
+addresses {
+	http = "127.0.0.1 203.0.113.10"
+}
+
+advertise {
+	http = "203.0.113.10:4646"
+	rpc = "203.0.113.10:4647"
+	serf = "203.0.113.10:4648"
+}
+
+server {
+	enabled = true
+	bootstrap_expect = 3
+}
+
+client {
+	enabled = true
+	servers = ["203.0.113.10:4647", "203.0.113.11:4647", "203.0.113.12:4647"]
+}
+
+consul {
+	address = "127.0.0.1:8500"
+	token = "consul-token"
+	client_service_name = "nomad-client-0123456789"
+	auto_advertise = true
+	server_auto_join = true
+	client_auto_join = true
+}
+
+plugin "docker" {
+	config {
+		allow_privileged = true
+		volumes {
+			enabled = true
+		}
+	}
+}
+
+telemetry {
+	collection_interval = "1s"
+	disable_hostname = true
+	prometheus_metrics = true
+	publish_allocation_metrics = true
+	publish_node_metrics = true
+}
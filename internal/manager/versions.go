@@ -0,0 +1,74 @@
+package manager
+
+import (
+	"strings"
+
+	"github.com/brimblehq/migration/internal/types"
+)
+
+// Versions used when the config leaves them empty.
+const (
+	defaultNodeJS = "20.x"
+	defaultNode   = "20.18.1"
+	defaultCNI    = "v1.5.1"
+
+	defaultTailscale = "1.76.6"
+	defaultNixpacks  = "1.29.1"
+	defaultCompose   = "2.29.7"
+)
+
+// versions returns the configured versions with defaults filled in.
+func (im *InstallationManager) versions() types.Versions {
+	versions := im.config.ClusterConfig.Versions
+
+	if versions.NodeJS == "" {
+		versions.NodeJS = defaultNodeJS
+	}
+	if versions.Node == "" {
+		versions.Node = defaultNode
+	}
+	versions.Node = strings.TrimPrefix(versions.Node, "v")
+	if versions.CNI == "" {
+		versions.CNI = defaultCNI
+	}
+	if !strings.HasPrefix(versions.CNI, "v") {
+		versions.CNI = "v" + versions.CNI
+	}
+	if !pinned(versions.Tailscale) {
+		versions.Tailscale = defaultTailscale
+	}
+	versions.Tailscale = strings.TrimPrefix(versions.Tailscale, "v")
+	if !pinned(versions.Nixpacks) {
+		versions.Nixpacks = defaultNixpacks
+	}
+	versions.Nixpacks = strings.TrimPrefix(versions.Nixpacks, "v")
+	if !pinned(versions.Compose) {
+		versions.Compose = defaultCompose
+	}
+	versions.Compose = strings.TrimPrefix(versions.Compose, "v")
+
+	return versions
+}
+
+// pinned reports whether a version asks for a specific release.
+func pinned(version string) bool {
+	return version != "" && version != "latest"
+}
+
+// consulImage is consul_image with its tag replaced by the pinned Consul version.
+func (im *InstallationManager) consulImage() string {
+	image := im.config.ClusterConfig.ConsulConfig.ConsulImage
+	version := im.versions().Consul
+	if !pinned(version) {
+		return image
+	}
+
+	if image == "" {
+		image = "hashicorp/consul"
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+
+	return image + ":" + strings.TrimPrefix(version, "v")
+}
@@ -0,0 +1,48 @@
+package pipeline
+
+import (
+	"context"
+	"sync"
+)
+
+// Barrier holds steps on several hosts until a set number of parties have
+// arrived. A party that fails before reaching the barrier must still Arrive so
+// the others are not held forever.
+type Barrier struct {
+	mu      sync.Mutex
+	pending int
+	ready   chan struct{}
+}
+
+func NewBarrier(parties int) *Barrier {
+	b := &Barrier{pending: parties, ready: make(chan struct{})}
+	if parties <= 0 {
+		close(b.ready)
+	}
+	return b
+}
+
+// Arrive counts one party in. Each party must arrive exactly once.
+func (b *Barrier) Arrive() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.pending == 0 {
+		return
+	}
+
+	b.pending--
+	if b.pending == 0 {
+		close(b.ready)
+	}
+}
+
+// Wait blocks until every party has arrived or ctx is done.
+func (b *Barrier) Wait(ctx context.Context) error {
+	select {
+	case <-b.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,289 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/brimblehq/migration/internal/retry"
+	"github.com/brimblehq/migration/internal/types"
+)
+
+// Step is one unit of provisioning. Once Run succeeds the host's progress is
+// recorded as ID.
+type Step struct {
+	Name string
+	ID   types.ServerStep
+	// DependsOn lists steps that must be recorded before this one runs. Each must
+	// be registered earlier in the pipeline.
+	DependsOn []types.ServerStep
+	// Timeout bounds a single attempt through Run's context; zero means no
+	// limit. An attempt that ignores its context is waited for regardless.
+	Timeout time.Duration
+	Retry   retry.Policy
+	// Wait, when set, blocks before the first attempt until conditions outside
+	// this host hold, such as a Barrier. It is not bound by Timeout.
+	Wait func(ctx context.Context) error
+	Run  func(ctx context.Context) error
+	// Rollback, when set, undoes a partial Run after the last attempt fails.
+	Rollback func(ctx context.Context) error
+	// Plan describes what Run would execute without touching the host.
+	Plan func() ([]string, error)
+	// Skip, when it returns true, records the step without running it, for
+	// steps switched off in the config.
+	Skip func() bool
+}
+
+// Pipeline runs steps in registration order. A host's progress is recorded as
+// a single step, so a step only runs once every step before it is recorded.
+type Pipeline struct {
+	initial types.ServerStep
+	final   types.ServerStep
+	steps   []Step
+	order   map[types.ServerStep]int
+}
+
+// New creates an empty pipeline. initial is recorded before any step has run
+// and final once the whole pipeline has.
+func New(initial, final types.ServerStep) *Pipeline {
+	return &Pipeline{
+		initial: initial,
+		final:   final,
+		order:   map[types.ServerStep]int{initial: 0},
+	}
+}
+
+// Add registers a step after the ones already added.
+func (p *Pipeline) Add(step Step) error {
+	if step.ID == "" || step.ID == p.final {
+		return fmt.Errorf("step %q has an invalid ID %q", step.Name, step.ID)
+	}
+	if _, ok := p.order[step.ID]; ok {
+		return fmt.Errorf("step %s is already registered", step.ID)
+	}
+	if step.Run == nil {
+		return fmt.Errorf("step %s has nothing to run", step.ID)
+	}
+	for _, dependency := range step.DependsOn {
+		if _, ok := p.order[dependency]; !ok {
+			return fmt.Errorf("step %s depends on %s, which is not registered before it", step.ID, dependency)
+		}
+	}
+
+	p.steps = append(p.steps, step)
+	p.order[step.ID] = len(p.steps)
+	return nil
+}
+
+// MustAdd is Add for pipelines built from static definitions.
+func (p *Pipeline) MustAdd(steps ...Step) *Pipeline {
+	for _, step := range steps {
+		if err := p.Add(step); err != nil {
+			panic(err)
+		}
+	}
+	return p
+}
+
+// Tune applies timeout overrides from the config to registered steps. Zero
+// values keep what the step was registered with.
+func (p *Pipeline) Tune(overrides map[types.ServerStep]types.StepTimeout) {
+	for i, step := range p.steps {
+		override, ok := overrides[step.ID]
+		if !ok {
+			continue
+		}
+
+		if override.Timeout > 0 {
+			p.steps[i].Timeout = time.Duration(override.Timeout)
+		}
+		p.steps[i].Retry = step.Retry.Merge(retry.FromConfig(override.Retry))
+	}
+}
+
+func (p *Pipeline) Steps() []Step {
+	return append([]Step{}, p.steps...)
+}
+
+// Sequence lists every recordable step in order, from initial to final.
+func (p *Pipeline) Sequence() []types.ServerStep {
+	sequence := []types.ServerStep{p.initial}
+	for _, step := range p.steps {
+		sequence = append(sequence, step.ID)
+	}
+	return append(sequence, p.final)
+}
+
+// Order is the position of a recorded step in Sequence.
+func (p *Pipeline) Order(step types.ServerStep) (int, bool) {
+	if step == p.final {
+		return len(p.steps) + 1, true
+	}
+	order, ok := p.order[step]
+	return order, ok
+}
+
+// State is how a step stands against a host's recorded progress.
+type State int
+
+const (
+	StateDone State = iota
+	StateReady
+	StateBlocked
+)
+
+// Check reports whether step is already recorded, can run now, or is blocked,
+// and in the last case which step it is waiting for.
+func (p *Pipeline) Check(current types.ServerStep, step Step) (State, types.ServerStep) {
+	currentOrder, _ := p.Order(current)
+	stepOrder := p.order[step.ID]
+
+	if currentOrder >= stepOrder {
+		return StateDone, ""
+	}
+
+	for _, dependency := range step.DependsOn {
+		if p.order[dependency] > currentOrder {
+			return StateBlocked, dependency
+		}
+	}
+
+	if currentOrder < stepOrder-1 {
+		return StateBlocked, p.Sequence()[stepOrder-1]
+	}
+
+	return StateReady, ""
+}
+
+// Hooks report progress to the caller. Done runs after each successful step,
+// typically to persist it; an error from Done stops the pipeline.
+type Hooks struct {
+	Start func(step Step)
+	// Skipped runs in place of Start for a step whose Skip returned true.
+	Skipped func(step Step)
+	Done    func(step Step) error
+	Fail    func(step Step, err error)
+}
+
+// Options narrow a run. With Only set, just that step runs and steps before it
+// must already be recorded.
+type Options struct {
+	Only  types.ServerStep
+	Hooks Hooks
+}
+
+// StepError is returned when a step fails or cannot run.
+type StepError struct {
+	Step types.ServerStep
+	Err  error
+}
+
+func (e *StepError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// Run executes every step not yet recorded past current and returns the last
+// step recorded. Errors are *StepError.
+func (p *Pipeline) Run(ctx context.Context, current types.ServerStep, opts Options) (types.ServerStep, error) {
+	for _, step := range p.steps {
+		if opts.Only != "" && opts.Only != step.ID {
+			continue
+		}
+
+		state, waitingFor := p.Check(current, step)
+		switch state {
+		case StateDone:
+			continue
+		case StateBlocked:
+			return current, &StepError{Step: step.ID, Err: fmt.Errorf("cannot run %s: prerequisite %s not met", step.Name, waitingFor)}
+		}
+
+		if err := ctx.Err(); err != nil {
+			return current, &StepError{Step: step.ID, Err: err}
+		}
+
+		if step.Skip != nil && step.Skip() {
+			if opts.Hooks.Skipped != nil {
+				opts.Hooks.Skipped(step)
+			}
+		} else if err := p.start(ctx, step, opts.Hooks); err != nil {
+			return current, err
+		}
+
+		if opts.Hooks.Done != nil {
+			if err := opts.Hooks.Done(step); err != nil {
+				if opts.Hooks.Fail != nil {
+					opts.Hooks.Fail(step, err)
+				}
+				return current, &StepError{Step: step.ID, Err: err}
+			}
+		}
+		current = step.ID
+	}
+
+	return current, nil
+}
+
+// start waits for and runs one step.
+func (p *Pipeline) start(ctx context.Context, step Step, hooks Hooks) error {
+	if hooks.Start != nil {
+		hooks.Start(step)
+	}
+
+	if step.Wait != nil {
+		if err := step.Wait(ctx); err != nil {
+			if hooks.Fail != nil {
+				hooks.Fail(step, err)
+			}
+			return &StepError{Step: step.ID, Err: fmt.Errorf("waiting to run %s: %w", step.Name, err)}
+		}
+	}
+
+	if err := p.runStep(ctx, step); err != nil {
+		if hooks.Fail != nil {
+			hooks.Fail(step, err)
+		}
+		return &StepError{Step: step.ID, Err: fmt.Errorf("error during %s: %w", step.Name, err)}
+	}
+
+	return nil
+}
+
+func (p *Pipeline) runStep(ctx context.Context, step Step) error {
+	err := retry.Do(ctx, step.Retry, func(int) error {
+		return runAttempt(ctx, step)
+	})
+
+	if err != nil && step.Rollback != nil {
+		if rollbackErr := step.Rollback(ctx); rollbackErr != nil {
+			return fmt.Errorf("%w (rollback failed: %v)", err, rollbackErr)
+		}
+	}
+
+	return err
+}
+
+// runAttempt runs one attempt with its context bounded by the step's timeout.
+// It returns only once Run does, even when Run ignores the deadline, so a retry
+// or Rollback never starts while the attempt is still working on the host.
+func runAttempt(ctx context.Context, step Step) error {
+	if step.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, step.Timeout)
+		defer cancel()
+	}
+
+	err := step.Run(ctx)
+	if step.Timeout > 0 && ctx.Err() == context.DeadlineExceeded {
+		// An attempt that overran its timeout failed, even if it went on to succeed.
+		if err == nil {
+			err = ctx.Err()
+		}
+		return fmt.Errorf("timed out after %s: %w", step.Timeout, err)
+	}
+	return err
+}
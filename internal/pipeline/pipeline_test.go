@@ -0,0 +1,368 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brimblehq/migration/internal/retry"
+	"github.com/brimblehq/migration/internal/types"
+)
+
+// recorder notes the order steps, hooks and rollbacks run in.
+type recorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recorder) add(event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *recorder) list() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.events...)
+}
+
+func (r *recorder) step(id types.ServerStep, err error) Step {
+	return Step{
+		Name: string(id),
+		ID:   id,
+		Run: func(context.Context) error {
+			r.add("run " + string(id))
+			return err
+		},
+	}
+}
+
+// testPipeline is verified -> base_installed -> consul_setup, where
+// consul_setup also depends on verified.
+func testPipeline(r *recorder) *Pipeline {
+	consul := r.step(types.StepConsulSetup, nil)
+	consul.DependsOn = []types.ServerStep{types.StepVerified}
+
+	return New(types.StepInitialized, types.StepCompleted).MustAdd(
+		r.step(types.StepVerified, nil),
+		r.step(types.StepBaseInstalled, nil),
+		consul,
+	)
+}
+
+func TestCheck(t *testing.T) {
+	p := testPipeline(&recorder{})
+	steps := p.Steps()
+
+	tests := []struct {
+		name       string
+		current    types.ServerStep
+		step       Step
+		state      State
+		waitingFor types.ServerStep
+	}{
+		{"first step from initial", types.StepInitialized, steps[0], StateReady, ""},
+		{"next step", types.StepVerified, steps[1], StateReady, ""},
+		{"recorded step", types.StepBaseInstalled, steps[0], StateDone, ""},
+		{"current step", types.StepBaseInstalled, steps[1], StateDone, ""},
+		{"everything after completed", types.StepCompleted, steps[2], StateDone, ""},
+		{"previous step missing", types.StepVerified, steps[2], StateBlocked, types.StepBaseInstalled},
+		{"dependency missing", types.StepInitialized, steps[2], StateBlocked, types.StepVerified},
+		{"unknown current step", types.ServerStep("unknown"), steps[1], StateBlocked, types.StepVerified},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, waitingFor := p.Check(tt.current, tt.step)
+			if state != tt.state || waitingFor != tt.waitingFor {
+				t.Errorf("Check(%s, %s) = %v, %q; want %v, %q", tt.current, tt.step.ID, state, waitingFor, tt.state, tt.waitingFor)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	errDone := errors.New("cannot record step")
+
+	tests := []struct {
+		name    string
+		current types.ServerStep
+		only    types.ServerStep
+		skip    types.ServerStep
+		doneErr types.ServerStep
+		last    types.ServerStep
+		errStep types.ServerStep
+		events  []string
+	}{
+		{
+			name:    "every step from initial",
+			current: types.StepInitialized,
+			last:    types.StepConsulSetup,
+			events: []string{
+				"start verified", "run verified", "done verified",
+				"start base_installed", "run base_installed", "done base_installed",
+				"start consul_setup", "run consul_setup", "done consul_setup",
+			},
+		},
+		{
+			name:    "resumes after the recorded step",
+			current: types.StepBaseInstalled,
+			last:    types.StepConsulSetup,
+			events:  []string{"start consul_setup", "run consul_setup", "done consul_setup"},
+		},
+		{
+			name:    "only the next step",
+			current: types.StepVerified,
+			only:    types.StepBaseInstalled,
+			last:    types.StepBaseInstalled,
+			events:  []string{"start base_installed", "run base_installed", "done base_installed"},
+		},
+		{
+			name:    "only a recorded step",
+			current: types.StepConsulSetup,
+			only:    types.StepVerified,
+			last:    types.StepConsulSetup,
+		},
+		{
+			name:    "only a blocked step",
+			current: types.StepVerified,
+			only:    types.StepConsulSetup,
+			last:    types.StepVerified,
+			errStep: types.StepConsulSetup,
+		},
+		{
+			name:    "skipped step is recorded without running",
+			current: types.StepVerified,
+			skip:    types.StepBaseInstalled,
+			last:    types.StepConsulSetup,
+			events: []string{
+				"skipped base_installed", "done base_installed",
+				"start consul_setup", "run consul_setup", "done consul_setup",
+			},
+		},
+		{
+			name:    "done error stops the pipeline",
+			current: types.StepInitialized,
+			doneErr: types.StepBaseInstalled,
+			last:    types.StepVerified,
+			errStep: types.StepBaseInstalled,
+			events: []string{
+				"start verified", "run verified", "done verified",
+				"start base_installed", "run base_installed", "done base_installed", "fail base_installed",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &recorder{}
+			p := testPipeline(r)
+			for i, step := range p.steps {
+				if step.ID == tt.skip {
+					p.steps[i].Skip = func() bool { return true }
+				}
+			}
+
+			hooks := Hooks{
+				Start:   func(step Step) { r.add("start " + string(step.ID)) },
+				Skipped: func(step Step) { r.add("skipped " + string(step.ID)) },
+				Done: func(step Step) error {
+					r.add("done " + string(step.ID))
+					if step.ID == tt.doneErr {
+						return errDone
+					}
+					return nil
+				},
+				Fail: func(step Step, err error) { r.add("fail " + string(step.ID)) },
+			}
+
+			last, err := p.Run(context.Background(), tt.current, Options{Only: tt.only, Hooks: hooks})
+			if last != tt.last {
+				t.Errorf("last step = %s, want %s", last, tt.last)
+			}
+
+			var stepErr *StepError
+			switch {
+			case tt.errStep == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.errStep != "" && !errors.As(err, &stepErr):
+				t.Errorf("error = %v, want a *StepError for %s", err, tt.errStep)
+			case tt.errStep != "" && stepErr.Step != tt.errStep:
+				t.Errorf("error is for %s, want %s", stepErr.Step, tt.errStep)
+			}
+			if tt.doneErr != "" && !errors.Is(err, errDone) {
+				t.Errorf("error = %v, want it to wrap the Done error", err)
+			}
+
+			if events := r.list(); !reflect.DeepEqual(events, tt.events) && (len(events) > 0 || len(tt.events) > 0) {
+				t.Errorf("events = %q, want %q", events, tt.events)
+			}
+		})
+	}
+}
+
+func TestRunRollsBackFailedStep(t *testing.T) {
+	errRun := errors.New("install failed")
+
+	tests := []struct {
+		name        string
+		rollbackErr error
+		wantErr     string
+	}{
+		{"rollback succeeds", nil, "error during base_installed: install failed"},
+		{"rollback fails", errors.New("cleanup failed"), "error during base_installed: install failed (rollback failed: cleanup failed)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &recorder{}
+			failing := r.step(types.StepBaseInstalled, errRun)
+			failing.Retry = retry.Fixed(2, time.Millisecond)
+			failing.Rollback = func(context.Context) error {
+				r.add("rollback base_installed")
+				return tt.rollbackErr
+			}
+
+			p := New(types.StepInitialized, types.StepCompleted).MustAdd(
+				r.step(types.StepVerified, nil),
+				failing,
+				r.step(types.StepConsulSetup, nil),
+			)
+
+			last, err := p.Run(context.Background(), types.StepInitialized, Options{})
+			if last != types.StepVerified {
+				t.Errorf("last step = %s, want %s", last, types.StepVerified)
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+
+			want := []string{"run verified", "run base_installed", "run base_installed", "rollback base_installed"}
+			if events := r.list(); !reflect.DeepEqual(events, want) {
+				t.Errorf("events = %q, want %q", events, want)
+			}
+		})
+	}
+}
+
+func TestRunWaitsForTimedOutAttempt(t *testing.T) {
+	r := &recorder{}
+
+	var mu sync.Mutex
+	running := 0
+	step := Step{
+		Name:    "slow",
+		ID:      types.StepBaseInstalled,
+		Timeout: 10 * time.Millisecond,
+		Retry:   retry.Fixed(2, time.Millisecond),
+		// Run ignores its context, like a remote command that keeps going.
+		Run: func(ctx context.Context) error {
+			mu.Lock()
+			running++
+			if running > 1 {
+				r.add("overlap")
+			}
+			mu.Unlock()
+
+			time.Sleep(50 * time.Millisecond)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+			r.add("attempt returned")
+			return ctx.Err()
+		},
+		Rollback: func(context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if running > 0 {
+				r.add("overlap")
+			}
+			r.add("rollback")
+			return nil
+		},
+	}
+
+	p := New(types.StepInitialized, types.StepCompleted).MustAdd(step)
+	_, err := p.Run(context.Background(), types.StepInitialized, Options{})
+	if err == nil || !strings.Contains(err.Error(), "timed out after 10ms") {
+		t.Errorf("error = %v, want a timeout", err)
+	}
+
+	want := []string{"attempt returned", "attempt returned", "rollback"}
+	if events := r.list(); !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+}
+
+func TestRunFailsLateSuccess(t *testing.T) {
+	r := &recorder{}
+	step := Step{
+		Name:    "slow",
+		ID:      types.StepVerified,
+		Timeout: 10 * time.Millisecond,
+		// Run ignores its context and succeeds after the timeout.
+		Run: func(context.Context) error {
+			time.Sleep(30 * time.Millisecond)
+			return nil
+		},
+	}
+
+	p := New(types.StepInitialized, types.StepCompleted).MustAdd(step)
+	hooks := Hooks{Done: func(step Step) error {
+		r.add("done " + string(step.ID))
+		return nil
+	}}
+
+	last, err := p.Run(context.Background(), types.StepInitialized, Options{Hooks: hooks})
+	if err == nil || !strings.Contains(err.Error(), "timed out after 10ms") {
+		t.Errorf("error = %v, want a timeout", err)
+	}
+	if last != types.StepInitialized {
+		t.Errorf("last step = %s, want %s", last, types.StepInitialized)
+	}
+	if events := r.list(); len(events) > 0 {
+		t.Errorf("events = %q, want the step not recorded", events)
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	errRun := errors.New("connection reset")
+
+	tests := []struct {
+		name string
+		// run is the attempt's result once the run is cancelled.
+		run func(ctx context.Context) error
+	}{
+		{"step returns the context error", func(ctx context.Context) error { return ctx.Err() }},
+		{"retry stops waiting", func(context.Context) error { return errRun }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			step := Step{
+				Name:  "cancelled",
+				ID:    types.StepVerified,
+				Retry: retry.Fixed(3, time.Minute),
+				Run: func(ctx context.Context) error {
+					cancel()
+					return tt.run(ctx)
+				},
+			}
+
+			p := New(types.StepInitialized, types.StepCompleted).MustAdd(step)
+			_, err := p.Run(ctx, types.StepInitialized, Options{})
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("error = %v, want it to wrap context.Canceled", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/brimblehq/migration/internal/types"
+)
+
+// Policy describes how a wait loop polls: up to Attempts calls, Interval apart,
+// the interval growing by Backoff after each failure up to MaxInterval.
+type Policy struct {
+	Attempts    int
+	Interval    time.Duration
+	Backoff     float64
+	MaxInterval time.Duration
+}
+
+// Fixed polls attempts times, interval apart.
+func Fixed(attempts int, interval time.Duration) Policy {
+	return Policy{Attempts: attempts, Interval: interval}
+}
+
+// FromConfig converts a policy from the timeouts section of the config.
+func FromConfig(config types.RetryPolicy) Policy {
+	return Policy{
+		Attempts:    config.Attempts,
+		Interval:    time.Duration(config.Interval),
+		Backoff:     config.Backoff,
+		MaxInterval: time.Duration(config.MaxInterval),
+	}
+}
+
+// Merge returns p with every non-zero field of override applied.
+func (p Policy) Merge(override Policy) Policy {
+	if override.Attempts > 0 {
+		p.Attempts = override.Attempts
+	}
+	if override.Interval > 0 {
+		p.Interval = override.Interval
+	}
+	if override.Backoff > 0 {
+		p.Backoff = override.Backoff
+	}
+	if override.MaxInterval > 0 {
+		p.MaxInterval = override.MaxInterval
+	}
+	return p
+}
+
+// Budget is roughly the longest the policy waits between attempts in total.
+func (p Policy) Budget() time.Duration {
+	var total time.Duration
+	for attempt := 1; attempt < p.Attempts; attempt++ {
+		total += p.delay(attempt)
+	}
+	return total
+}
+
+func (p Policy) delay(attempt int) time.Duration {
+	delay := p.Interval
+	for i := 1; i < attempt && p.Backoff > 1; i++ {
+		delay = time.Duration(float64(delay) * p.Backoff)
+		if p.MaxInterval > 0 && delay >= p.MaxInterval {
+			return p.MaxInterval
+		}
+	}
+	return delay
+}
+
+// Do calls fn until it returns nil, the attempts run out or ctx is done, and
+// returns the last error. Attempts below one mean a single call.
+func Do(ctx context.Context, policy Policy, fn func(attempt int) error) error {
+	attempts := policy.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = fn(attempt); err == nil {
+			return nil
+		}
+
+		if attempt == attempts {
+			break
+		}
+
+		timer := time.NewTimer(policy.delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w (stopped waiting: %w)", err, ctx.Err())
+		case <-timer.C:
+		}
+	}
+
+	return err
+}
@@ -1,6 +1,7 @@
 package ssh
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -101,6 +102,65 @@ func (s *SSHClient) ExecuteCommandWithOutput(command string) (string, error) {
 	return string(output), nil
 }
 
+// ExecuteCommandContext runs command like ExecuteCommand, but closes the
+// session when ctx is done instead of waiting for the command to finish.
+func (s *SSHClient) ExecuteCommandContext(ctx context.Context, command string) error {
+	session, err := s.Client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	return runContext(ctx, session, func() error { return session.Run(command) })
+}
+
+// ExecuteCommandWithOutputContext is ExecuteCommandWithOutput bound to ctx like
+// ExecuteCommandContext.
+func (s *SSHClient) ExecuteCommandWithOutputContext(ctx context.Context, command string) (string, error) {
+	session, err := s.Client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	var output []byte
+	err = runContext(ctx, session, func() error {
+		var err error
+		output, err = session.Output(command)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to execute command: %w", err)
+	}
+
+	return string(output), nil
+}
+
+// runContext runs run on session, killing the remote command and closing the
+// session if ctx is done first. A cancelled run reports ctx's error.
+func runContext(ctx context.Context, session *ssh.Session, run func() error) error {
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Signal(ssh.SIGKILL)
+			session.Close()
+		case <-done:
+		}
+	}()
+
+	err := run()
+	if ctx.Err() != nil {
+		return fmt.Errorf("command interrupted: %w", ctx.Err())
+	}
+	return err
+}
+
 func (s *SSHClient) Close() error {
 	return s.Client.Close()
 }
@@ -0,0 +1,122 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// FileOptions control how a file is written on the host. Files are streamed
+// over an exec channel into a temporary file next to the target and renamed
+// into place, so readers never see a partial file and contents are never
+// interpolated into a shell command.
+type FileOptions struct {
+	// Mode defaults to 0644.
+	Mode os.FileMode
+	// Owner is passed to chown, e.g. "nomad:nomad"; empty leaves the writer as owner.
+	Owner string
+	// Sudo writes as root, for paths the SSH user cannot write to.
+	Sudo bool
+}
+
+// WriteFile writes data to remotePath.
+func (s *SSHClient) WriteFile(remotePath string, data []byte, opts FileOptions) error {
+	return s.write(remotePath, bytes.NewReader(data), int64(len(data)), opts)
+}
+
+// Upload copies the local file at localPath to remotePath.
+func (s *SSHClient) Upload(localPath, remotePath string, opts FileOptions) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", localPath, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %v", localPath, err)
+	}
+
+	return s.write(remotePath, file, info.Size(), opts)
+}
+
+// Download copies remotePath on the host into the local file at localPath.
+func (s *SSHClient) Download(remotePath, localPath string) error {
+	session, err := s.Client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	file, err := os.Create(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", localPath, err)
+	}
+	defer file.Close()
+
+	var stderr bytes.Buffer
+	session.Stdout = file
+	session.Stderr = &stderr
+
+	if err := session.Run("cat " + shellQuote(remotePath)); err != nil {
+		os.Remove(localPath)
+		return fmt.Errorf("failed to download %s: %v: %s", remotePath, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return file.Close()
+}
+
+func (s *SSHClient) write(remotePath string, content io.Reader, size int64, opts FileOptions) error {
+	mode := opts.Mode
+	if mode == 0 {
+		mode = 0644
+	}
+
+	target := shellQuote(remotePath)
+	temp := shellQuote(path.Join(path.Dir(remotePath), "."+path.Base(remotePath)+".XXXXXX"))
+
+	script := []string{
+		"set -e",
+		fmt.Sprintf("tmp=$(mktemp %s)", temp),
+		`trap 'rm -f "$tmp"' EXIT`,
+		`cat > "$tmp"`,
+		fmt.Sprintf(`[ "$(wc -c < "$tmp")" -eq %d ] || { echo "short write" >&2; exit 1; }`, size),
+		fmt.Sprintf(`chmod %04o "$tmp"`, mode.Perm()),
+	}
+	if opts.Owner != "" {
+		script = append(script, fmt.Sprintf(`chown %s "$tmp"`, shellQuote(opts.Owner)))
+	}
+	script = append(script,
+		fmt.Sprintf(`mv -f "$tmp" %s`, target),
+		"trap - EXIT",
+	)
+
+	command := "sh -c " + shellQuote(strings.Join(script, "; "))
+	if opts.Sudo {
+		command = "sudo " + command
+	}
+
+	session, err := s.Client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stdin = content
+	session.Stderr = &stderr
+
+	if err := session.Run(command); err != nil {
+		return fmt.Errorf("failed to write %s: %v: %s", remotePath, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// shellQuote quotes value as a single shell word.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -199,18 +199,23 @@ func (m *TempSSHManager) getHostKey(host string) (ssh.PublicKey, error) {
 	return hostKey, nil
 }
 
-func (m *TempSSHManager) Cleanup(ctx context.Context, client *SSHClient) error {
+// Cleanup revokes the key once a command is done with every server: it is
+// marked expired, removed from each server's authorized_keys and deleted
+// locally. A server that cannot be reached keeps the key until
+// CleanupExpiredKeys removes it on a later run.
+func (m *TempSSHManager) Cleanup(ctx context.Context, servers []types.Server) error {
 	if err := m.db.MarkKeyAsExpired(ctx, m.keyID); err != nil {
 		return fmt.Errorf("failed to mark key as expired: %w", err)
 	}
 
 	cleanupCmd := fmt.Sprintf("sed -i '/%s/d' ~/.ssh/authorized_keys", m.keyID)
-	if err := client.ExecuteCommand(cleanupCmd); err != nil {
-		return fmt.Errorf("failed to remove key from server: %w", err)
-	}
 
-	if err := m.db.MarkKeyAsCleaned(ctx, m.keyID); err != nil {
-		return fmt.Errorf("failed to mark key as cleaned: %w", err)
+	var failed []string
+	for _, server := range servers {
+		if err := m.removeFrom(server, cleanupCmd); err != nil {
+			log.Printf("Failed to remove key from %s: %v", server.Host, err)
+			failed = append(failed, server.Host)
+		}
 	}
 
 	keyPath := filepath.Join(m.keyDir, fmt.Sprintf("%s.pem", m.keyID))
@@ -218,9 +223,32 @@ func (m *TempSSHManager) Cleanup(ctx context.Context, client *SSHClient) error {
 		return fmt.Errorf("failed to remove local private key: %w", err)
 	}
 
+	if len(failed) > 0 {
+		return fmt.Errorf("key is still authorized on %s; a later run removes it", strings.Join(failed, ", "))
+	}
+
+	if err := m.db.MarkKeyAsCleaned(ctx, m.keyID); err != nil {
+		return fmt.Errorf("failed to mark key as cleaned: %w", err)
+	}
+
 	return nil
 }
 
+func (m *TempSSHManager) removeFrom(server types.Server, cleanupCmd string) error {
+	config, err := m.GetSSHConfig(server.Host)
+	if err != nil {
+		return err
+	}
+
+	client, err := NewSSHClient(server, config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.ExecuteCommand(cleanupCmd)
+}
+
 func (m *TempSSHManager) savePrivateKey() error {
 	privateKeyPEM := &pem.Block{
 		Type:  "RSA PRIVATE KEY",
@@ -7,7 +7,25 @@ const (
 	RoleClient ClusterRole = "client"
 )
 
+// NetworkMode selects the address each host binds and advertises for cluster
+// traffic.
+type NetworkMode string
+
+const (
+	NetworkPublic  NetworkMode = "public"
+	NetworkPrivate NetworkMode = "private"
+	// NetworkTailscale uses the address the host gets when it joins the tailnet.
+	NetworkTailscale NetworkMode = "tailscale"
+)
+
 type ClusterMember struct {
-	Server Server
-	Roles  []ClusterRole
+	Server Server        `json:"server"`
+	Roles  []ClusterRole `json:"roles"`
+}
+
+// Topology is the persisted layout of the cluster: every member and the Nomad
+// roles it runs, in the order the members joined.
+type Topology struct {
+	Members   []ClusterMember `json:"members"`
+	UpdatedAt string          `json:"-"`
 }
@@ -1,24 +1,83 @@
 package types
 
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
 type Config struct {
 	Servers       []Server      `json:"servers"`
 	ClusterConfig ClusterConfig `json:"cluster_config"`
+	Timeouts      Timeouts      `json:"timeouts"`
+	// Bundle is an offline bundle built by the bundle command. When set, hosts
+	// install from it instead of the internet. {os} and {arch} expand to each
+	// host's distribution release, such as ubuntu-22.04, and architecture.
+	Bundle string `json:"bundle,omitempty"`
+	// DownloadManifest is a JSON file of Downloads. Every artifact is
+	// verified on the host against it before it runs or installs, and a
+	// download missing from it, or a missing manifest, fails the install.
+	DownloadManifest string `json:"download_manifest,omitempty"`
+	// InsecureDownloads fetches artifacts missing from the download manifest,
+	// or every artifact when there is none, without verifying them.
+	InsecureDownloads bool `json:"insecure_downloads,omitempty"`
+}
+
+// Downloads maps each download URL to what the file must verify against.
+type Downloads map[string]Download
+
+type Download struct {
+	SHA256 string `json:"sha256"`
+	// Signature is the URL of a detached signature, checked with GPGKey or
+	// MinisignKey where the publisher signs the artifact.
+	Signature string `json:"signature,omitempty"`
+	// GPGKey is the URL of the armored public key the signature is made with.
+	GPGKey string `json:"gpg_key,omitempty"`
+	// MinisignKey is the minisign public key the signature is made with.
+	MinisignKey string `json:"minisign_key,omitempty"`
 }
 
 type Server struct {
-	Host       string `json:"host"`
-	Username   string `json:"username"`
-	KeyPath    string `json:"key_path,omitempty"`
-	DataCenter string `json:"datacenter"`
-	PublicIP   string `json:"public_ip"`
-	PrivateIP  string `json:"private_ip"`
-	AuthMethod string `json:"auth_method,omitempty"`
+	Host       string        `json:"host"`
+	Username   string        `json:"username"`
+	KeyPath    string        `json:"key_path,omitempty"`
+	DataCenter string        `json:"datacenter"`
+	PublicIP   string        `json:"public_ip"`
+	PrivateIP  string        `json:"private_ip"`
+	AuthMethod string        `json:"auth_method,omitempty"`
+	Roles      []ClusterRole `json:"roles,omitempty"`
+	// Components overrides the cluster-wide components for this server.
+	Components *Components `json:"components,omitempty"`
+	// Nomad is layered over the cluster-wide nomad options for this server.
+	Nomad *NomadOptions `json:"nomad,omitempty"`
 }
 
 type ClusterConfig struct {
 	ConsulConfig     ConsulConfig     `json:"consul"`
 	MonitoringConfig MonitoringConfig `json:"monitoring"`
 	Versions         Versions         `json:"versions"`
+	Components       Components       `json:"components"`
+	Nomad            NomadOptions     `json:"nomad"`
+	// NetworkMode is public when unset.
+	NetworkMode NetworkMode `json:"network_mode,omitempty"`
+	// ACL enables Nomad ACLs. The management token and the scoped runner and
+	// monitoring tokens are stored encrypted in the state database.
+	ACL bool `json:"acl,omitempty"`
+}
+
+// Components switches optional installers and monitoring jobs on or off. An
+// unset switch leaves the component on.
+type Components struct {
+	Redis *bool `json:"redis,omitempty"`
+	// Node covers Node.js, NVM and the global npm tools.
+	Node       *bool `json:"node,omitempty"`
+	Nixpacks   *bool `json:"nixpacks,omitempty"`
+	Infisical  *bool `json:"infisical,omitempty"`
+	Tailscale  *bool `json:"tailscale,omitempty"`
+	Monitoring *bool `json:"monitoring,omitempty"`
+	// MonitoringJobs limits monitoring to these embedded jobs, e.g. "loki";
+	// empty deploys them all.
+	MonitoringJobs []string `json:"monitoring_jobs,omitempty"`
 }
 
 type ConsulConfig struct {
@@ -33,8 +92,80 @@ type MonitoringConfig struct {
 	MetricsPort     int    `json:"metrics_port"`
 }
 
+// Versions pins what gets installed. Empty, or "latest" where the installer
+// supports it, takes the newest release.
 type Versions struct {
 	Docker string `json:"docker"`
+	// NodeJS is the NodeSource release line installed system-wide, e.g. "20.x".
 	NodeJS string `json:"nodejs"`
 	Nomad  string `json:"nomad"`
+	// Consul replaces the tag of consul_image for the Consul client container.
+	Consul string `json:"consul,omitempty"`
+	// CNI is the containernetworking plugins release, e.g. "v1.5.1".
+	CNI string `json:"cni,omitempty"`
+	// Node is the exact Node.js version installed through NVM, e.g. "20.18.1".
+	Node string `json:"node,omitempty"`
+	// Tailscale, Nixpacks and Compose are the releases downloaded for hosts
+	// and offline bundles; Compose is only installed on Amazon Linux.
+	Tailscale string `json:"tailscale,omitempty"`
+	Nixpacks  string `json:"nixpacks,omitempty"`
+	Compose   string `json:"compose,omitempty"`
+}
+
+// Timeouts overrides how long steps and wait loops may take. Zero values keep
+// the built-in defaults.
+type Timeouts struct {
+	// Steps bounds whole provisioning steps, keyed by step name.
+	Steps map[ServerStep]StepTimeout `json:"steps,omitempty"`
+
+	ConsulReady  RetryPolicy `json:"consul_ready"`
+	NomadHealthy RetryPolicy `json:"nomad_healthy"`
+	NomadCluster RetryPolicy `json:"nomad_cluster"`
+	NomadLeader  RetryPolicy `json:"nomad_leader"`
+	JobHealthy   RetryPolicy `json:"job_healthy"`
+	ServiceReady RetryPolicy `json:"service_ready"`
+	NodeDrain    RetryPolicy `json:"node_drain"`
+}
+
+type StepTimeout struct {
+	Timeout Duration    `json:"timeout"`
+	Retry   RetryPolicy `json:"retry"`
+}
+
+type RetryPolicy struct {
+	Attempts    int      `json:"attempts"`
+	Interval    Duration `json:"interval"`
+	Backoff     float64  `json:"backoff"`
+	MaxInterval Duration `json:"max_interval"`
+}
+
+// Duration reads either a Go duration string such as "90s" or a number of seconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case float64:
+		*d = Duration(time.Duration(v * float64(time.Second)))
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %v", v, err)
+		}
+		*d = Duration(parsed)
+	case nil:
+		*d = 0
+	default:
+		return fmt.Errorf("invalid duration %s", string(data))
+	}
+
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
 }
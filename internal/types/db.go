@@ -22,6 +22,17 @@ type ServerState struct {
 	Status      string     `db:"status"` // "active", "inactive", "failed"
 	Identifier  string     `db:"identifier"`
 	CurrentStep ServerStep `db:"step"`
+	Arch        string     `db:"arch"`    // "amd64" or "arm64"; empty until detected
+	Address     string     `db:"address"` // cluster address for the network mode; empty until the Consul step
 	CreatedAt   string     `db:"created_at"`
 	UpdatedAt   string     `db:"updated_at"`
 }
+
+// ClusterAddress is the address other hosts reach this server on, falling back
+// to the public IP for servers provisioned before addresses were recorded.
+func (s ServerState) ClusterAddress() string {
+	if s.Address != "" {
+		return s.Address
+	}
+	return s.PublicIP
+}
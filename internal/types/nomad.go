@@ -1,14 +1,23 @@
 package types
 
+// NomadConfig is the agent configuration written to /etc/nomad.d/nomad.hcl.
 type NomadConfig struct {
-	DataCenter     string
-	BindAddr       string
+	DataCenter string
+	DataDir    string
+	LogLevel   string
+	BindAddr   string
+	// Addresses overrides bind_addr for individual protocols.
+	Addresses      AdvertiseAddrs
 	AdvertiseAddrs AdvertiseAddrs
 	ServerConfig   *ServerConfig
-	ClientConfig   ClientConfig
-	ConsulConfig   ConsulConfig
-	Plugins        map[string]interface{}
-	Telemetry      TelemetryConfig
+	ClientConfig   *ClientConfig
+	ConsulConfig   NomadConsulConfig
+	ACLEnabled     bool
+	// Plugins maps a plugin name to its stanza body; nested maps render as blocks.
+	Plugins map[string]interface{}
+	// Limits is the agent's limits stanza.
+	Limits    map[string]interface{}
+	Telemetry TelemetryConfig
 }
 
 type AdvertiseAddrs struct {
@@ -23,8 +32,22 @@ type ServerConfig struct {
 }
 
 type ClientConfig struct {
-	Enabled bool
-	Servers []string
+	Enabled     bool
+	Servers     []string
+	Meta        map[string]string
+	HostVolumes map[string]HostVolume
+}
+
+// NomadConsulConfig is the consul stanza of the agent configuration.
+type NomadConsulConfig struct {
+	Address           string
+	Token             string
+	ClientServiceName string
+}
+
+type HostVolume struct {
+	Path     string `json:"path"`
+	ReadOnly bool   `json:"read_only,omitempty"`
 }
 
 type TelemetryConfig struct {
@@ -34,3 +57,15 @@ type TelemetryConfig struct {
 	PublishAllocationMetrics bool
 	PublishNodeMetrics       bool
 }
+
+// NomadOptions are extra stanzas layered onto the generated nomad.hcl.
+type NomadOptions struct {
+	// ClientMeta is added to the client's meta stanza.
+	ClientMeta map[string]string `json:"client_meta,omitempty"`
+	// HostVolumes are exposed by the client; each path is created on the host.
+	HostVolumes map[string]HostVolume `json:"host_volumes,omitempty"`
+	// Plugins are merged over the default docker plugin configuration.
+	Plugins map[string]interface{} `json:"plugins,omitempty"`
+	// Limits is the agent's limits stanza, e.g. {"http_max_conns_per_client": 200}.
+	Limits map[string]interface{} `json:"limits,omitempty"`
+}
@@ -1,13 +1,34 @@
 package ui
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
+
+type Option struct {
+	Name    string
+	Default string
+	Usage   string
+}
+
+type CommandHelp struct {
+	Name     string
+	Summary  string
+	Options  []Option
+	Examples []string
+}
+
+const footer = `
+        For support: hello@brimble.app
+        Documentation: https://docs.brimble.app
+        `
 
 func PrintBanner(onlyBanner ...bool) {
 	banner := `
     ██████╗ ██████╗ ██╗███╗   ███╗██████╗ ██╗     ███████╗
     ██╔══██╗██╔══██╗██║████╗ ████║██╔══██╗██║     ██╔════╝
-    ██████╔╝██████╔╝██║██╔████╔██║██████╔╝██║     █████╗  
-    ██╔══██╗██╔══██╗██║██║╚██╔╝██║██╔══██╗██║     ██╔══╝  
+    ██████╔╝██████╔╝██║██╔████╔██║██████╔╝██║     █████╗
+    ██╔══██╗██╔══██╗██║██║╚██╔╝██║██╔══██╗██║     ██╔══╝
     ██████╔╝██║  ██║██║██║ ╚═╝ ██║██████╔╝███████╗███████╗
     ╚═════╝ ╚═╝  ╚═╝╚═╝╚═╝     ╚═╝╚═════╝ ╚══════╝╚══════╝
     `
@@ -19,22 +40,69 @@ func PrintBanner(onlyBanner ...bool) {
 	if !onlyBannerValue {
 		usage := `
         Usage:
-            brimble --license-key=<key> [--config=<path>]
-        
-        Options:
-            --license-key   Your Brimble license key (required)
-            --config        Path to configuration file (default: ./config.json)
-        
-        Examples:
-            brimble --license-key=XXXX-XXXX-XXXX-XXXX
-            brimble --license-key=XXXX-XXXX-XXXX-XXXX --config=./my-config.json
-        
-        For support: hello@brimble.app
-        Documentation: https://docs.brimble.app
+            brimble <command> [options]
+
+        Run "brimble help <command>" for details on a command.
         `
-		fmt.Printf("\033[1;36m%s\033[0m\n%s", banner, usage)
+		fmt.Printf("\033[1;36m%s\033[0m\n%s%s", banner, usage, footer)
 		return
 	}
 
 	fmt.Printf("\033[1;36m%s\033[0m\n", banner)
 }
+
+// PrintCommands renders the banner followed by the list of available subcommands.
+func PrintCommands(commands []CommandHelp) {
+	PrintBanner(true)
+
+	width := 0
+	for _, cmd := range commands {
+		if len(cmd.Name) > width {
+			width = len(cmd.Name)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("\n        Usage:\n            brimble <command> [options]\n\n        Commands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "            %-*s   %s\n", width, cmd.Name, cmd.Summary)
+	}
+	b.WriteString("\n        Run \"brimble help <command>\" for details on a command.\n")
+
+	fmt.Printf("%s%s", b.String(), footer)
+}
+
+// PrintCommandHelp renders the banner followed by the usage, options and examples of one subcommand.
+func PrintCommandHelp(help CommandHelp) {
+	PrintBanner(true)
+
+	width := 0
+	for _, opt := range help.Options {
+		if len(opt.Name)+2 > width {
+			width = len(opt.Name) + 2
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n        %s\n\n        Usage:\n            brimble %s [options]\n", help.Summary, help.Name)
+
+	if len(help.Options) > 0 {
+		b.WriteString("\n        Options:\n")
+		for _, opt := range help.Options {
+			usage := opt.Usage
+			if opt.Default != "" && opt.Default != "false" {
+				usage = fmt.Sprintf("%s (default: %s)", usage, opt.Default)
+			}
+			fmt.Fprintf(&b, "            %-*s   %s\n", width, "--"+opt.Name, usage)
+		}
+	}
+
+	if len(help.Examples) > 0 {
+		b.WriteString("\n        Examples:\n")
+		for _, example := range help.Examples {
+			fmt.Fprintf(&b, "            %s\n", example)
+		}
+	}
+
+	fmt.Printf("%s%s", b.String(), footer)
+}